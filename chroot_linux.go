@@ -0,0 +1,52 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-cgi.
+
+// tupi-cgi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-cgi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-cgi. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// checkChroot checks that the scripts can be run in a chroot. Only root
+// can chroot and the scripts must not run as root, because root can
+// leave the chroot.
+func checkChroot(c Config) error {
+	if geteuid() != 0 {
+		return ChrootPrivilegeError
+	}
+	uid, _ := c.getInt("CHROOT_UID")
+	gid, _ := c.getInt("CHROOT_GID")
+	if uid <= 0 || gid <= 0 {
+		return ChrootCredentialError
+	}
+	return nil
+}
+
+// setChroot makes cmd run with root as its root directory as the user
+// and group of CHROOT_UID and CHROOT_GID.
+func setChroot(cmd *exec.Cmd, root string, c Config) {
+	uid, _ := c.getInt("CHROOT_UID")
+	gid, _ := c.getInt("CHROOT_GID")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Chroot:     root,
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+	cmd.Dir = "/"
+}
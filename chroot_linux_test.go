@@ -0,0 +1,106 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-cgi.
+
+// tupi-cgi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-cgi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-cgi. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInit_Chroot(t *testing.T) {
+	defer func() { geteuid = os.Geteuid }()
+
+	var testCases = []struct {
+		name string
+		euid int
+		uid  int
+		gid  int
+		err  error
+	}{
+		{"root", 0, 65534, 65534, nil},
+		{"unprivileged", 1000, 65534, 65534, ChrootPrivilegeError},
+		{"no uid", 0, 0, 65534, ChrootCredentialError},
+		{"no gid", 0, 65534, 0, ChrootCredentialError},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			geteuid = func() int { return test.euid }
+			conf := map[string]any{
+				"CGI_DIR":    "./build",
+				"CHROOT":     true,
+				"CHROOT_UID": test.uid,
+				"CHROOT_GID": test.gid,
+			}
+			err := Init("some.domain", &conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Invalid error %v", err)
+			}
+		})
+	}
+}
+
+func TestServe_Chroot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot needs root")
+	}
+	cgiDir := t.TempDir()
+	content, err := os.ReadFile(filepath.Join("build", "envthing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(cgiDir, "envthing"), content, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the cgi dir is the root of the script, that is not root
+	err = os.Chmod(cgiDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := map[string]any{
+		"CGI_DIR":    cgiDir,
+		"CHROOT":     true,
+		"CHROOT_UID": 65534,
+		"CHROOT_GID": 65534,
+	}
+	r, _ := http.NewRequest("GET", "/envthing/some/thing", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	// the script only exists at /envthing inside the chroot
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	for _, v := range []string{
+		"SCRIPT_NAME=/envthing\n",
+		"SCRIPT_FILENAME=/envthing\n",
+		"PATH_TRANSLATED=/some/thing\n",
+	} {
+		if !strings.Contains(w.Body.String(), v) {
+			t.Fatalf("%s not in %s", v, w.Body.String())
+		}
+	}
+}
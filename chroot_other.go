@@ -0,0 +1,30 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-cgi.
+
+// tupi-cgi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-cgi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-cgi. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+
+package main
+
+import "os/exec"
+
+// checkChroot checks that the scripts can be run in a chroot. Chroot is
+// only supported on linux.
+func checkChroot(c Config) error {
+	return ChrootUnsupportedError
+}
+
+func setChroot(cmd *exec.Cmd, root string, c Config) {}
@@ -0,0 +1,74 @@
+// Copyright 2024 Juca Crispim <juca@poraodojuca.net>
+
+// This file is part of tupi-cgi.
+
+// tupi-cgi is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// tupi-cgi is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with tupi-cgi. If not, see <http://www.gnu.org/licenses/>.
+
+//go:build unix
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServe_KillGrace(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "trap.cgi"), `#!/bin/sh
+trap 'echo term > "$QUERY_STRING"; exit 0' TERM
+while true; do sleep 0.05; done
+`)
+	writeScript(t, filepath.Join(cgiDir, "ignore.cgi"), `#!/bin/sh
+trap '' TERM
+while true; do sleep 0.05; done
+`)
+
+	var testCases = []struct {
+		name   string
+		script string
+		conf   map[string]any
+		marker string
+	}{
+		{"sigkill", "/trap.cgi", map[string]any{}, ""},
+		{"sigterm", "/trap.cgi", map[string]any{"KILL_GRACE": 1}, "term\n"},
+		{"sigkill after grace", "/ignore.cgi", map[string]any{"KILL_GRACE": 0.2}, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			marker := filepath.Join(t.TempDir(), "marker")
+			test.conf["CGI_DIR"] = cgiDir
+			test.conf["CGI_TIMEOUT"] = 0.1
+			r, _ := http.NewRequest("GET", test.script+"?"+marker, nil)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusGatewayTimeout {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("Script not killed %s", elapsed)
+			}
+			content, _ := os.ReadFile(marker)
+			if string(content) != test.marker {
+				t.Fatalf("Invalid marker %q", content)
+			}
+		})
+	}
+}
@@ -18,16 +18,35 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var INTERNAL_SERVER_ERROR_MSG = "Internal server error"
@@ -37,149 +56,2274 @@ var NoCgiDirError = errors.New("[tupi-cgi] CGI_DIR missing from config")
 var BadCgiDirError = errors.New("[tupi-cgi] CGI_DIR wrong config value")
 var UnknownSchemeError = errors.New("[tupi-cgi] Unknown scheme")
 var InvalidCgiResponse = errors.New("[tupi-cgi] Invalid cgi response")
+var BadConfigValueError = errors.New("[tupi-cgi] Bad config value")
+var CgiTimeoutError = errors.New("[tupi-cgi] Cgi timeout")
+var BadRequestPathError = errors.New("[tupi-cgi] Bad request path")
+var NotExecutableError = errors.New("[tupi-cgi] Script not executable")
+var BadConfigFileError = errors.New("[tupi-cgi] Bad config file")
+var ChrootPrivilegeError = errors.New("[tupi-cgi] CHROOT needs root privileges")
+var ChrootUnsupportedError = errors.New("[tupi-cgi] CHROOT not supported")
+var ChrootCredentialError = errors.New("[tupi-cgi] CHROOT needs a non root CHROOT_UID and CHROOT_GID")
+var ReadTimeoutError = errors.New("[tupi-cgi] Request body read timeout")
+var MissingInterpreterError = errors.New("[tupi-cgi] Interpreter not found")
+var InitTimeoutError = errors.New("[tupi-cgi] Init timeout")
+var InvalidContentTypeError = errors.New("[tupi-cgi] Invalid Content-Type")
+var TooManyEnvVarsError = errors.New("[tupi-cgi] Too many env vars")
+var UnknownDomainError = errors.New("[tupi-cgi] Unknown domain")
+var HeaderTimeoutError = errors.New("[tupi-cgi] Header timeout")
+
+var DEFAULT_AUTH_REALM = "Restricted"
+var DEFAULT_CGI_PATH = "/usr/local/bin:/usr/bin:/bin"
+var DEFAULT_REQUEST_ID_HEADER = "X-Request-Id"
+var DEFAULT_BREAKER_COOLDOWN = 30 * time.Second
+var DEFAULT_UNIX_REMOTE_ADDR = "unix"
+var DEFAULT_RETRY_AFTER = 1
+var DEFAULT_WARMUP_TIMEOUT = 30 * time.Second
+
+// now and execContext are used to create the timeout context for the
+// cgi execution. They are vars so tests can control time.
+var now = time.Now
+var execContext = context.WithDeadline
+
+// fsInterface is the file system where the cgi dir, the scripts and
+// the config file are looked up.
+type fsInterface interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+}
+
+// osFS is the fsInterface of the os file system
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// fs is the file system used by Init and to find the scripts. It is a var
+// so tests can use a fake file system.
+var fs fsInterface = osFS{}
+
+// geteuid is used to check the privileges for CHROOT. It is a var so
+// tests can check unprivileged users.
+var geteuid = os.Geteuid
+
+// methodsWithoutBody are the methods that never have the request body
+// sent to the cgi.
+var methodsWithoutBody = map[string]bool{
+	"GET":  true,
+	"HEAD": true,
+}
+
+// methodsWithBody are the methods that always have the request body sent
+// to the cgi, even when the content length is unknown.
+var methodsWithBody = map[string]bool{
+	"POST":  true,
+	"PUT":   true,
+	"PATCH": true,
+}
+
+// metaHeaders are the request headers sent to the cgi as meta-variables
+// with their own names. They are not sent again as HTTP_ variables.
+var metaHeaders = []string{
+	"Auth-Type",
+	"Remote-User",
+	"Content-Type",
+	"Server-Software",
+}
+
+// domains are the cgi dirs for the domains initialized by Init
+var domains = make(map[string]string)
+
+// initConfs are the configs passed to Init by domain
+var initConfs = make(map[string]map[string]any)
+
+// reloadedConfs are the configs set by Reload by the identity of the
+// config passed to Init, see confId
+var reloadedConfs = make(map[uintptr]Config)
+var domainsMutex sync.RWMutex
+
+// Config is the plugin configuration for a domain.
+type Config map[string]any
+
+type confKind int
+
+const (
+	confStringList confKind = iota
+	confString
+	confBool
+	confDuration
+	confInt
+	confStringMap
+	confDurationMap
+	confStringListMap
+)
+
+// optionalConf are the config keys that may be used beside CGI_DIR
+var optionalConf = map[string]confKind{
+	"STRIP_HEADERS":             confStringList,
+	"INDEX_SCRIPT":              confString,
+	"DIR_REDIRECT":              confBool,
+	"CGI_TIMEOUT":               confDuration,
+	"REQUIRE_AUTH":              confBool,
+	"AUTH_REALM":                confString,
+	"STREAM_THRESHOLD":          confInt,
+	"CGI_PATH":                  confString,
+	"DEBUG_TIMING":              confBool,
+	"REQUEST_ID_HEADER":         confString,
+	"GENERATE_REQUEST_ID":       confBool,
+	"MAX_PATH_SEGMENTS":         confInt,
+	"TRY_EXTENSIONS":            confStringList,
+	"ADD_HEADERS":               confStringMap,
+	"FORCE_HEADERS":             confBool,
+	"ISINDEX_ARGS":              confBool,
+	"SCRIPT_TIMEOUTS":           confDurationMap,
+	"STDERR_LOG":                confString,
+	"BREAKER_THRESHOLD":         confInt,
+	"BREAKER_COOLDOWN":          confDuration,
+	"ALLOWED_RESPONSE_HEADERS":  confStringList,
+	"DEFAULT_SHELL":             confString,
+	"SCRIPT_METHODS":            confStringListMap,
+	"FORCE_CLOSE":               confBool,
+	"DEFAULT_CHARSET":           confString,
+	"CONFIG_FILE":               confString,
+	"REDACT_ENV":                confStringList,
+	"WARMUP_CMD":                confStringList,
+	"WARMUP_PATTERN":            confString,
+	"UNIX_REMOTE_ADDR":          confString,
+	"CHROOT":                    confBool,
+	"CHROOT_UID":                confInt,
+	"CHROOT_GID":                confInt,
+	"FORCE_DOWNLOAD_EXTENSIONS": confStringList,
+	"ERROR_PAGES":               confStringMap,
+	"REQUIRE_CONTENT_TYPE":      confStringListMap,
+	"DEBUG_ROUTING":             confBool,
+	"READ_TIMEOUT":              confDuration,
+	"COLLAPSE_SLASHES":          confBool,
+	"TRUST_ENV_HEADERS":         confString,
+	"ACCESS_LOG":                confString,
+	"QUERY_AS_ARG":              confBool,
+	"INTERPRETERS":              confStringMap,
+	"MAX_CONCURRENT":            confInt,
+	"RETRY_AFTER":               confInt,
+	"PUBLIC_PORT":               confInt,
+	"TRUST_FORWARDED_HEADERS":   confBool,
+	"MAX_HEADERS":               confInt,
+	"STRICT_HEADER_NAMES":       confBool,
+	"RATE_LIMIT":                confInt,
+	"RATE_BURST":                confInt,
+	"INIT_TIMEOUT":              confDuration,
+	"INVALID_CONTENT_TYPE":      confString,
+	"BODY_TO_FILE":              confBool,
+	"DOWNGRADE_PROTOCOL":        confBool,
+	"KILL_GRACE":                confDuration,
+	"OMIT_EMPTY_PATH_INFO":      confBool,
+	"RESOLVE_CGI_DIR":           confBool,
+	"DEBUG_STDERR":              confBool,
+	"MAX_ENV_VARS":              confInt,
+	"STATUS_PATH":               confString,
+	"LOAD_DOTENV":               confBool,
+	"FLUSH_INTERVAL":            confDuration,
+	"SCRIPT_IP_ALLOW":           confStringListMap,
+	"PATH_INFO_AS_ARGS":         confBool,
+	"METHOD_OVERRIDE":           confBool,
+	"FULL_DUPLEX":               confBool,
+	"FALLBACK_SCRIPT":           confString,
+	"HEADER_TIMEOUT":            confDuration,
+	"LOG_QUERY_STRING":          confBool,
+	"AUTO_ETAG":                 confBool,
+	"FIRST_HEADER_ONLY":         confBool,
+	"MAX_URI_LENGTH":            confInt,
+	"TRUST_ENV_NAMES":           confStringList,
+}
+
+func (c Config) validate() error {
+	for key, kind := range optionalConf {
+		var err error
+		switch kind {
+		case confStringList:
+			_, err = c.getStringList(key)
+		case confString:
+			_, err = c.getString(key)
+		case confBool:
+			_, err = c.getBool(key)
+		case confDuration:
+			_, err = c.getDuration(key)
+		case confInt:
+			_, err = c.getInt(key)
+		case confStringMap:
+			_, err = c.getStringMap(key)
+		case confDurationMap:
+			_, err = c.getDurationMap(key)
+		case confStringListMap:
+			_, err = c.getStringListMap(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getStringList returns a list of strings from the config. Missing keys
+// return a nil list.
+func (c Config) getStringList(key string) ([]string, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, nil
+	}
+	l, ok := toStringList(v)
+	if !ok {
+		return nil, badConfigValue(key)
+	}
+	return l, nil
+}
+
+// toStringList converts a list from the config to a list of strings.
+func toStringList(v any) ([]string, bool) {
+	switch l := v.(type) {
+	case []string:
+		return l, true
+	case []any:
+		strs := make([]string, 0, len(l))
+		for _, i := range l {
+			s, ok := i.(string)
+			if !ok {
+				return nil, false
+			}
+			strs = append(strs, s)
+		}
+		return strs, true
+	}
+	return nil, false
+}
+
+// getStringMap returns a map of strings from the config. Missing keys
+// return a nil map.
+func (c Config) getStringMap(key string) (map[string]string, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, nil
+	}
+	switch m := v.(type) {
+	case map[string]string:
+		return m, nil
+	case map[string]any:
+		strs := make(map[string]string, len(m))
+		for k, i := range m {
+			s, ok := i.(string)
+			if !ok {
+				return nil, badConfigValue(key)
+			}
+			strs[k] = s
+		}
+		return strs, nil
+	}
+	return nil, badConfigValue(key)
+}
+
+// getString returns a string from the config. Missing keys return
+// an empty string.
+func (c Config) getString(key string) (string, error) {
+	v, exists := c[key]
+	if !exists {
+		return "", nil
+	}
+	str, ok := v.(string)
+	if !ok {
+		return "", badConfigValue(key)
+	}
+	return str, nil
+}
+
+// getBool returns a bool from the config. Missing keys return false.
+func (c Config) getBool(key string) (bool, error) {
+	v, exists := c[key]
+	if !exists {
+		return false, nil
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, badConfigValue(key)
+	}
+	return b, nil
+}
+
+// getInt returns an int from the config. Missing keys return 0.
+func (c Config) getInt(key string) (int, error) {
+	v, exists := c[key]
+	if !exists {
+		return 0, nil
+	}
+	switch n := v.(type) {
+	case int:
+		return n, nil
+	case int64:
+		return int(n), nil
+	case float64:
+		// numbers from json config files are float64
+		if n == math.Trunc(n) {
+			return int(n), nil
+		}
+	}
+	return 0, badConfigValue(key)
+}
+
+// getDuration returns a duration from a config value in seconds.
+// Missing keys return 0.
+func (c Config) getDuration(key string) (time.Duration, error) {
+	v, exists := c[key]
+	if !exists {
+		return 0, nil
+	}
+	d, ok := toDuration(v)
+	if !ok {
+		return 0, badConfigValue(key)
+	}
+	return d, nil
+}
+
+// getDurationMap returns a map of durations from a config value with
+// the durations in seconds. Missing keys return a nil map.
+func (c Config) getDurationMap(key string) (map[string]time.Duration, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, badConfigValue(key)
+	}
+	durations := make(map[string]time.Duration, len(m))
+	for k, i := range m {
+		d, ok := toDuration(i)
+		if !ok {
+			return nil, badConfigValue(key)
+		}
+		durations[k] = d
+	}
+	return durations, nil
+}
+
+// getStringListMap returns a map of lists of strings from the config.
+// Missing keys return a nil map.
+func (c Config) getStringListMap(key string) (map[string][]string, error) {
+	v, exists := c[key]
+	if !exists {
+		return nil, nil
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, badConfigValue(key)
+	}
+	lists := make(map[string][]string, len(m))
+	for k, i := range m {
+		l, ok := toStringList(i)
+		if !ok {
+			return nil, badConfigValue(key)
+		}
+		lists[k] = l
+	}
+	return lists, nil
+}
+
+// toDuration converts a number of seconds to a duration.
+func toDuration(v any) (time.Duration, bool) {
+	var secs float64
+	switch n := v.(type) {
+	case int:
+		secs = float64(n)
+	case int64:
+		secs = float64(n)
+	case float64:
+		secs = n
+	default:
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+func badConfigValue(key string) error {
+	return fmt.Errorf("%w: %s", BadConfigValueError, key)
+}
 
 func Init(domain string, conf *map[string]any) error {
-	c := (*conf)
+	c := Config(*conf)
 	if c == nil {
 		return MissingConfigError
 	}
 
-	d, exists := c["CGI_DIR"]
-	if !exists {
-		return NoCgiDirError
+	cgiDir, err := checkConfig(c)
+	if err != nil {
+		return err
+	}
+	warmup(cgiDir, c)
+
+	domainsMutex.Lock()
+	defer domainsMutex.Unlock()
+	if old, exists := initConfs[domain]; exists {
+		delete(reloadedConfs, confId(old))
+	}
+	domains[domain] = cgiDir
+	initConfs[domain] = *conf
+	delete(reloadedConfs, confId(*conf))
+	return nil
+}
+
+// Reload replaces the config of a domain initialized by Init. The new
+// config is validated as in Init and is used by the requests that start
+// after Reload returns. The requests being served keep the old config.
+func Reload(domain string, conf map[string]any) error {
+	if conf == nil {
+		return MissingConfigError
+	}
+	c := make(Config, len(conf))
+	for k, v := range conf {
+		c[k] = v
+	}
+	cgiDir, err := checkConfig(c)
+	if err != nil {
+		return err
+	}
+
+	domainsMutex.Lock()
+	defer domainsMutex.Unlock()
+	initConf, exists := initConfs[domain]
+	if !exists {
+		return fmt.Errorf("%w: %s", UnknownDomainError, domain)
+	}
+	domains[domain] = cgiDir
+	reloadedConfs[confId(initConf)] = c
+	return nil
+}
+
+// confId returns the identity of a config map. It is the same for the
+// copies of the map, so Serve finds the config set by Reload whatever
+// the request host is.
+func confId(conf map[string]any) uintptr {
+	return reflect.ValueOf(conf).Pointer()
+}
+
+// getReloadedConf returns the config set by Reload for the config
+// passed to Init.
+func getReloadedConf(conf map[string]any) (Config, bool) {
+	domainsMutex.RLock()
+	defer domainsMutex.RUnlock()
+	c, exists := reloadedConfs[confId(conf)]
+	return c, exists
+}
+
+// checkConfig loads CONFIG_FILE into the config and validates it. It
+// returns the cgi dir.
+func checkConfig(c Config) (string, error) {
+	err := loadConfigFile(c)
+	if err != nil {
+		return "", err
+	}
+
+	d, exists := c["CGI_DIR"]
+	if !exists {
+		return "", NoCgiDirError
+	}
+
+	cgiDir, ok := d.(string)
+	if !ok {
+		return "", BadCgiDirError
+	}
+
+	err = c.validate()
+	if err != nil {
+		return "", err
+	}
+
+	initTimeout, _ := c.getDuration("INIT_TIMEOUT")
+	err = statTimeout(cgiDir, initTimeout)
+	if err != nil {
+		return "", err
+	}
+	err = checkInterpreters(c)
+	if err != nil {
+		return "", err
+	}
+	err = checkIpAllow(c)
+	if err != nil {
+		return "", err
+	}
+
+	chroot, _ := c.getBool("CHROOT")
+	if chroot {
+		err = checkChroot(c)
+		if err != nil {
+			return "", err
+		}
+	}
+	return cgiDir, nil
+}
+
+// statTimeout checks that path exists. If timeout is not zero and stat
+// takes longer than it, an InitTimeoutError is returned. The stat is
+// left running in the background.
+func statTimeout(path string, timeout time.Duration) error {
+	if timeout <= 0 {
+		_, err := fs.Stat(path)
+		return err
+	}
+	// the goroutine may outlive the call, so it uses the file system
+	// of the call and not the package var.
+	f := fs
+	ch := make(chan error, 1)
+	go func() {
+		_, err := f.Stat(path)
+		ch <- err
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("%w: %s", InitTimeoutError, path)
+	}
+}
+
+// warmup runs WARMUP_CMD for each script in the cgi dir whose name matches
+// WARMUP_PATTERN. The script path is the last argument of the command.
+// The warmup takes at most INIT_TIMEOUT, or DEFAULT_WARMUP_TIMEOUT without
+// it, and the scripts left when it times out are not warmed up. Failures
+// are logged.
+func warmup(cgiDir string, c Config) {
+	command, _ := c.getStringList("WARMUP_CMD")
+	if len(command) == 0 {
+		return
+	}
+	pattern, _ := c.getString("WARMUP_PATTERN")
+	if pattern == "" {
+		pattern = "*"
+	}
+	timeout, _ := c.getDuration("INIT_TIMEOUT")
+	if timeout <= 0 {
+		timeout = DEFAULT_WARMUP_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	filepath.WalkDir(cgiDir, func(path string, d os.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			log.Printf("[tupi-cgi] warmup %s: %s", cgiDir, InitTimeoutError)
+			return filepath.SkipAll
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		matched, _ := filepath.Match(pattern, d.Name())
+		if !matched {
+			return nil
+		}
+		args := append(command[1:len(command):len(command)], path)
+		cmd := exec.CommandContext(ctx, command[0], args...)
+		// children of the command that keep its output open don't
+		// block Init after the timeout.
+		cmd.WaitDelay = time.Second
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("[tupi-cgi] warmup %s: %s %s", path, err.Error(), out)
+		}
+		return nil
+	})
+}
+
+// checkInterpreters checks that the INTERPRETERS exist.
+func checkInterpreters(c Config) error {
+	interpreters, _ := c.getStringMap("INTERPRETERS")
+	missing := make([]string, 0)
+	for _, interpreter := range interpreters {
+		_, err := fs.Stat(interpreter)
+		if err != nil {
+			missing = append(missing, interpreter)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("%w: %s", MissingInterpreterError, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// loadConfigFile merges the json file in CONFIG_FILE into the config.
+// Keys already in the config are not replaced.
+func loadConfigFile(c Config) error {
+	path, err := c.getString("CONFIG_FILE")
+	if err != nil || path == "" {
+		return err
+	}
+	f, err := fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", BadConfigFileError, err.Error())
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", BadConfigFileError, path, err.Error())
+	}
+	var fileConf map[string]any
+	err = json.Unmarshal(content, &fileConf)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", BadConfigFileError, path, err.Error())
+	}
+	for k, v := range fileConf {
+		if _, exists := c[k]; !exists {
+			c[k] = v
+		}
+	}
+	return nil
+}
+
+// NewHandler returns an http.Handler that serves the cgi scripts of
+// a domain. The config is validated as in Init.
+func NewHandler(domain string, conf map[string]any) (http.Handler, error) {
+	err := Init(domain, &conf)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Serve(w, r, &conf)
+	}), nil
+}
+
+// Domains returns the configured domains and their cgi dirs.
+func Domains() map[string]string {
+	domainsMutex.RLock()
+	defer domainsMutex.RUnlock()
+	d := make(map[string]string, len(domains))
+	for k, v := range domains {
+		d[k] = v
+	}
+	return d
+}
+
+func Serve(w http.ResponseWriter, r *http.Request, conf *map[string]any) {
+	c := Config(*conf)
+	if reloaded, exists := getReloadedConf(*conf); exists {
+		c = reloaded
+	}
+	accessLog, _ := c.getString("ACCESS_LOG")
+	if accessLog != "" {
+		aw := &accessLogWriter{ResponseWriter: w}
+		w = aw
+		defer writeAccessLog(accessLog, r, aw, c)
+	}
+
+	// long uris are rejected before any work with the file system
+	maxURILength, _ := c.getInt("MAX_URI_LENGTH")
+	if maxURILength > 0 && len(requestURI(r)) > maxURILength {
+		WriteCgiError(w, http.StatusRequestURITooLong, c)
+		return
+	}
+	// the counters and the slots are by the configured dir, not by the
+	// release it points to, so they are kept between deploys.
+	cgiDir, _ := c.getString("CGI_DIR")
+	c = resolveCgiDir(c)
+
+	requireAuth, _ := c.getBool("REQUIRE_AUTH")
+	if requireAuth && r.Header.Get("Authorization") == "" {
+		realm, _ := c.getString("AUTH_REALM")
+		if realm == "" {
+			realm = DEFAULT_AUTH_REALM
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+		WriteCgiError(w, http.StatusUnauthorized, c)
+		return
+	}
+
+	statusPath, _ := c.getString("STATUS_PATH")
+	if statusPath != "" && r.URL.Path == statusPath {
+		writeStatus(w, r, cgiDir, c)
+		return
+	}
+	stats := getDirStats(cgiDir)
+	stats.total.Add(1)
+	stats.inFlight.Add(1)
+	defer stats.inFlight.Add(-1)
+
+	maxSegments, _ := c.getInt("MAX_PATH_SEGMENTS")
+	if maxSegments > 0 && countPathSegments(r.URL.Path) > maxSegments {
+		WriteCgiError(w, http.StatusRequestURITooLong, c)
+		return
+	}
+
+	maxHeaders, _ := c.getInt("MAX_HEADERS")
+	if maxHeaders > 0 && len(r.Header) > maxHeaders {
+		WriteCgiError(w, http.StatusRequestHeaderFieldsTooLarge, c)
+		return
+	}
+
+	m, err := getMetaVars(r, c)
+	if errors.Is(err, BadRequestPathError) {
+		log.Println(err.Error())
+		WriteCgiError(w, http.StatusBadRequest, c)
+		return
+	}
+	if err != nil {
+		log.Printf(err.Error())
+		WriteCgiError(w, http.StatusInternalServerError, c)
+		return
+	}
+	debugRouting, _ := c.getBool("DEBUG_ROUTING")
+	if debugRouting {
+		w.Header().Set("X-CGI-Script", m["SCRIPT_FILENAME"])
+		w.Header().Set("X-CGI-Path-Info", m["PATH_INFO"])
+	}
+	if m["SCRIPT_FILENAME"] == "" {
+		WriteCgiError(w, http.StatusNotFound, c)
+		return
+	}
+	setRequestId(w, r, m, c)
+	redirect, _ := c.getBool("DIR_REDIRECT")
+	index, _ := c.getString("INDEX_SCRIPT")
+	if redirect && isDirRequest(r, m, index) {
+		// with repeated slashes the location would be a protocol
+		// relative url to another host, ie: //evil.com/
+		loc := collapseSlashes(r.URL.EscapedPath()) + "/"
+		if r.URL.RawQuery != "" {
+			loc += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, loc, http.StatusMovedPermanently)
+		return
+	}
+	if !ipAllowed(m["SCRIPT_FILENAME"], m["REMOTE_ADDR"], c) {
+		WriteCgiError(w, http.StatusForbidden, c)
+		return
+	}
+	if ok, allowed := methodAllowed(m["SCRIPT_FILENAME"], m["REQUEST_METHOD"], c); !ok {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		WriteCgiError(w, http.StatusMethodNotAllowed, c)
+		return
+	}
+	if !contentTypeAllowed(m["SCRIPT_FILENAME"], r.Header.Get("Content-Type"), c) {
+		WriteCgiError(w, http.StatusUnsupportedMediaType, c)
+		return
+	}
+	if breakerOpen(m["SCRIPT_FILENAME"], c) {
+		WriteCgiError(w, http.StatusServiceUnavailable, c)
+		return
+	}
+	if !rateAllowed(m["SCRIPT_FILENAME"], c) {
+		WriteCgiError(w, http.StatusTooManyRequests, c)
+		return
+	}
+	release, acquired := acquireSlot(r, cgiDir, c)
+	if !acquired {
+		retryAfter, _ := c.getInt("RETRY_AFTER")
+		if retryAfter <= 0 {
+			retryAfter = DEFAULT_RETRY_AFTER
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		WriteCgiError(w, http.StatusServiceUnavailable, c)
+		return
+	}
+	defer release()
+	// The first read of the body makes the http server send the
+	// 100 Continue to clients using Expect: 100-continue, so the body is
+	// only read after the request was accepted.
+	if r.ContentLength > 0 && r.Body == nil {
+		WriteCgiError(w, http.StatusBadRequest, c)
+		return
+	}
+	var rawBody []byte = nil
+	// with FULL_DUPLEX the body is sent to the script while it is read
+	fullDuplex, _ := c.getBool("FULL_DUPLEX")
+	fullDuplex = fullDuplex && hasBody(r)
+	if fullDuplex {
+		defer r.Body.Close()
+	} else if hasBody(r) {
+		defer r.Body.Close()
+		readTimeout, _ := c.getDuration("READ_TIMEOUT")
+		rawBody, err = readBody(w, r.Body, readTimeout)
+		if errors.Is(err, ReadTimeoutError) {
+			log.Println(err.Error())
+			WriteCgiError(w, http.StatusRequestTimeout, c)
+			return
+		}
+		if err != nil {
+			WriteCgiError(w, http.StatusBadRequest, c)
+			return
+		}
+	}
+	bodyToFile, _ := c.getBool("BODY_TO_FILE")
+	if bodyToFile && rawBody != nil {
+		path, err := writeBodyFile(rawBody)
+		if err != nil {
+			log.Println(err.Error())
+			WriteCgiError(w, http.StatusInternalServerError, c)
+			return
+		}
+		defer os.Remove(path)
+		m["CGI_BODY_FILE"] = path
+		rawBody = nil
+	}
+	debugTiming, _ := c.getBool("DEBUG_TIMING")
+	if debugTiming {
+		w = &timingWriter{ResponseWriter: w, start: now()}
+	}
+	ctx := r.Context()
+	timeout := getTimeout(m["SCRIPT_FILENAME"], c)
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = execContext(ctx, now().Add(timeout))
+		defer cancel()
+	}
+	threshold, _ := c.getInt("STREAM_THRESHOLD")
+	var ok bool
+	if fullDuplex {
+		ok = serveDuplex(ctx, w, r, &m, c)
+	} else if threshold > 0 {
+		ok = serveStream(ctx, w, &m, c, bodyReader(rawBody), threshold)
+	} else {
+		ok = serveBuffered(ctx, w, r, &m, c, &rawBody)
+	}
+	// a script killed because the client went away did not fail, so
+	// clients can't open the breaker for everyone.
+	if r.Context().Err() == nil {
+		breakerRecord(m["SCRIPT_FILENAME"], ok, c)
+	}
+}
+
+// requestURI returns the uri sent by the client, or the uri built from
+// the request url for requests not read by a server.
+func requestURI(r *http.Request) string {
+	if r.RequestURI != "" {
+		return r.RequestURI
+	}
+	return r.URL.RequestURI()
+}
+
+// resolveCgiDir returns a copy of the config with the symlinks in CGI_DIR
+// resolved if RESOLVE_CGI_DIR is true, so a request uses the same dir from
+// the script lookup to its execution, even if the symlink is changed by
+// a deploy meanwhile. If the dir can't be resolved the config is returned
+// as is.
+func resolveCgiDir(c Config) Config {
+	resolve, _ := c.getBool("RESOLVE_CGI_DIR")
+	if !resolve {
+		return c
+	}
+	cgiDir, _ := c.getString("CGI_DIR")
+	resolved, err := filepath.EvalSymlinks(cgiDir)
+	if err != nil {
+		log.Println(err.Error())
+		return c
+	}
+	resolvedConf := make(Config, len(c))
+	for k, v := range c {
+		resolvedConf[k] = v
+	}
+	resolvedConf["CGI_DIR"] = resolved
+	return resolvedConf
+}
+
+// writeBodyFile writes the request body to a temp file for BODY_TO_FILE.
+// The caller must remove the file.
+func writeBodyFile(body []byte) (string, error) {
+	f, err := os.CreateTemp("", "tupi-cgi-body-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.Write(body)
+	if err != nil {
+		os.Remove(f.Name()) // notest
+		return "", err      // notest
+	}
+	return f.Name(), nil
+}
+
+// serveBuffered serves the cgi response after the script exits. The
+// response of server-sent events is streamed as the script writes it. It
+// returns false if the script failed.
+func serveBuffered(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	m *map[string]string, c Config, rawBody *[]byte) bool {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	cmd, br, headers, stsInt, err := startResponse(ctx, cancel, m, c,
+		bodyReader(*rawBody))
+	if err != nil {
+		writeExecError(w, err, c)
+		return false
+	}
+	if isEventStream(headers) {
+		return streamResponse(ctx, w, m, c, cmd, br, headers, stsInt, nil, true)
+	}
+	buf := getOutputBuffer()
+	defer putOutputBuffer(buf)
+	buf.ReadFrom(br)
+	err = waitCmd(ctx, cmd)
+	if err != nil {
+		writeExecError(w, err, c)
+		return false
+	}
+	body := buf.Bytes()
+	setResponseHeaders(w, headers, m, c)
+	if notModified(w, r, stsInt, body, c) {
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	fixContentLength(w, r, stsInt, len(body))
+	w.WriteHeader(stsInt)
+	w.Write(body)
+	return true
+}
+
+// notModified sets an ETag with the hash of the body for AUTO_ETAG and
+// informs if it matches the If-None-Match of the request. The ETag set
+// by the script is never replaced. HEAD responses have no body to hash,
+// so they get no ETag.
+func notModified(w http.ResponseWriter, r *http.Request, status int, body []byte,
+	c Config) bool {
+	autoETag, _ := c.getBool("AUTO_ETAG")
+	if !autoETag || status != http.StatusOK || w.Header().Get("ETag") != "" ||
+		r.Method == http.MethodHead {
+		return false
+	}
+	sum := sha256.Sum256(body)
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	w.Header().Set("ETag", etag)
+	if r.Method != http.MethodGet {
+		return false
+	}
+	// the comparison is weak, see rfc9110 section 13.1.2
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveStream serves the cgi response buffering up to threshold bytes of
+// the body. Bigger responses are streamed to the client and with a zero
+// threshold nothing is buffered. It returns false if the script failed.
+func serveStream(ctx context.Context, w http.ResponseWriter, m *map[string]string,
+	c Config, stdin io.Reader, threshold int) bool {
+	tr, tw, err := os.Pipe()
+	if err != nil {
+		writeExecError(w, err, c) // notest
+		return false              // notest
+	}
+	defer tr.Close()
+	trailers := readTrailers(tr)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	cmd, br, headers, stsInt, err := startResponse(ctx, cancel, m, c, stdin, tw)
+	tw.Close()
+	if err != nil {
+		writeExecError(w, err, c)
+		return false
+	}
+
+	// server-sent events are never buffered
+	unbuffered := threshold == 0 || isEventStream(headers)
+	var buf []byte
+	if !unbuffered {
+		buf, _ = io.ReadAll(io.LimitReader(br, int64(threshold)+1))
+	}
+	if !unbuffered && len(buf) <= threshold {
+		err = waitCmd(ctx, cmd)
+		if err != nil {
+			writeExecError(w, err, c)
+			return false
+		}
+		setResponseHeaders(w, headers, m, c)
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+		w.WriteHeader(stsInt)
+		w.Write(buf)
+		setTrailers(w, <-trailers)
+		return true
+	}
+	if !streamResponse(ctx, w, m, c, cmd, br, headers, stsInt, buf, unbuffered) {
+		return false
+	}
+	setTrailers(w, <-trailers)
+	return true
+}
+
+// startResponse starts the cgi script and reads the headers of its
+// response. The script is killed if the headers take longer than
+// HEADER_TIMEOUT, with HeaderTimeoutError as the cause of ctx, but the
+// body may take any time. The returned reader is at the start of the body
+// and the caller must read it until EOF and then call waitCmd. If an error
+// is returned the script has already exited.
+func startResponse(ctx context.Context, cancel context.CancelCauseFunc,
+	m *map[string]string, c Config, stdin io.Reader, extra ...*os.File) (
+	*exec.Cmd, *bufio.Reader, http.Header, int, error) {
+	cmd, stdout, err := startCmd(ctx, m, c, stdin, extra...)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	br := bufio.NewReader(stdout)
+	headerTimeout, _ := c.getDuration("HEADER_TIMEOUT")
+	var headerTimer *time.Timer
+	if headerTimeout > 0 {
+		headerTimer = time.AfterFunc(headerTimeout, func() {
+			cancel(HeaderTimeoutError)
+		})
+	}
+	headers, err := readCgiHeaders(br)
+	if headerTimer != nil && !headerTimer.Stop() {
+		err = HeaderTimeoutError
+	}
+	var stsInt int
+	if err == nil {
+		stsInt, err = getStatus(headers)
+	}
+	if err == nil {
+		err = checkContentType(headers, c)
+	}
+	if err != nil {
+		io.Copy(io.Discard, br)
+		werr := waitCmd(ctx, cmd)
+		if werr != nil {
+			err = werr
+		}
+		if errors.Is(context.Cause(ctx), HeaderTimeoutError) {
+			err = fmt.Errorf("%w: %s", HeaderTimeoutError, cmd.Path)
+		}
+		return nil, nil, nil, 0, err
+	}
+	return cmd, br, headers, stsInt, nil
+}
+
+// streamResponse streams the cgi response to the client. buf is the part
+// of the body already read from br. Unbuffered responses are flushed after
+// each write of the script. It returns false if the script failed.
+func streamResponse(ctx context.Context, w http.ResponseWriter, m *map[string]string,
+	c Config, cmd *exec.Cmd, br *bufio.Reader, headers http.Header, stsInt int,
+	buf []byte, unbuffered bool) bool {
+	setResponseHeaders(w, headers, m, c)
+	w.Header().Del("Content-Length")
+	if forceClose, _ := c.getBool("FORCE_CLOSE"); forceClose {
+		w.Header().Set("Connection", "close")
+	}
+	w.WriteHeader(stsInt)
+	interval, _ := c.getDuration("FLUSH_INTERVAL")
+	if unbuffered {
+		// the client gets the response before the first write
+		http.NewResponseController(w).Flush()
+		interval = 0
+	}
+	err := writeStream(w, io.MultiReader(bytes.NewReader(buf), br), interval)
+	if err != nil {
+		log.Println(err.Error())
+		io.Copy(io.Discard, br)
+	}
+	err = waitCmd(ctx, cmd)
+	if err != nil {
+		log.Println(err.Error())
+		return false
+	}
+	return true
+}
+
+// serveDuplex serves the cgi response while the request body is still
+// being sent to the script. The response is not buffered. It returns
+// false if the script failed.
+func serveDuplex(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	m *map[string]string, c Config) bool {
+	// http/1 handlers can't read the body after the response is
+	// written unless full duplex is enabled. http/2 always is.
+	rc := http.NewResponseController(w)
+	rc.EnableFullDuplex()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		writeExecError(w, err, c) // notest
+		return false              // notest
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := io.Copy(pw, r.Body)
+		pw.Close()
+		// EPIPE means the script doesn't read stdin anymore. Other
+		// errors are from the client and the script must not take
+		// a truncated body as complete.
+		if err != nil && !errors.Is(err, syscall.EPIPE) && ctx.Err() == nil {
+			log.Println(err.Error())
+			cancel()
+		}
+	}()
+	ok := serveStream(ctx, w, m, c, pr, 0)
+	// the body must not be read after the handler returns, so a copy
+	// blocked by a stalled client is stopped with a read deadline.
+	cancel()
+	pr.Close()
+	select {
+	case <-done:
+	default:
+		if rc.SetReadDeadline(time.Now()) == nil {
+			<-done
+		}
+	}
+	return ok
+}
+
+// isEventStream informs if the cgi response is a stream of server-sent
+// events.
+func isEventStream(headers http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(headers.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// readTrailers reads the trailers the cgi writes to the file descriptor 3.
+// The trailers are sent to the returned channel when the script closes
+// the file.
+func readTrailers(r io.Reader) <-chan http.Header {
+	ch := make(chan http.Header, 1)
+	go func() {
+		// the trailers end at eof, there is no need for an empty line.
+		end := strings.NewReader("\n")
+		br := bufio.NewReader(io.MultiReader(io.LimitReader(r, 64*1024), end))
+		trailers, _ := readCgiHeaders(br)
+		io.Copy(io.Discard, r)
+		ch <- trailers
+	}()
+	return ch
+}
+
+// setTrailers sets the trailers declared in the Trailer header of
+// the response.
+func setTrailers(w http.ResponseWriter, trailers http.Header) {
+	if trailers == nil {
+		return
+	}
+	for _, declared := range w.Header().Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			name = strings.TrimSpace(name)
+			for _, v := range trailers.Values(name) {
+				w.Header().Add(name, v)
+			}
+		}
+	}
+}
+
+// dirStats are the request counters of a cgi dir for STATUS_PATH
+type dirStats struct {
+	inFlight atomic.Int64
+	total    atomic.Int64
+}
+
+// allDirStats are the request counters by cgi dir
+var allDirStats = make(map[string]*dirStats)
+var allDirStatsMutex sync.Mutex
+
+// getDirStats returns the request counters for the cgi dir
+func getDirStats(cgiDir string) *dirStats {
+	allDirStatsMutex.Lock()
+	defer allDirStatsMutex.Unlock()
+	stats, exists := allDirStats[cgiDir]
+	if !exists {
+		stats = &dirStats{}
+		allDirStats[cgiDir] = stats
+	}
+	return stats
+}
+
+// writeStatus writes the status page of STATUS_PATH, a json with the
+// domain, the configured cgi dir and the request counters.
+func writeStatus(w http.ResponseWriter, r *http.Request, cgiDir string,
+	c Config) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		WriteCgiError(w, http.StatusMethodNotAllowed, c)
+		return
+	}
+	stats := getDirStats(cgiDir)
+	status := map[string]any{
+		"domain":         getDomainForRequest(r),
+		"cgi_dir":        cgiDir,
+		"in_flight":      stats.inFlight.Load(),
+		"total_requests": stats.total.Load(),
+	}
+	body, _ := json.Marshal(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// slotsKey identifies a semaphore. The size is part of the key so a
+// reload that changes MAX_CONCURRENT gets a new semaphore.
+type slotsKey struct {
+	domain string
+	cgiDir string
+	size   int
+}
+
+// slots are the semaphores that limit the concurrent scripts by domain
+// and cgi dir
+var slots = make(map[slotsKey]chan struct{})
+var slotsMutex sync.Mutex
+
+// getSlots returns the semaphore with size slots for the domain and the
+// cgi dir.
+func getSlots(domain string, cgiDir string, size int) chan struct{} {
+	key := slotsKey{domain: domain, cgiDir: cgiDir, size: size}
+	slotsMutex.Lock()
+	defer slotsMutex.Unlock()
+	s, exists := slots[key]
+	if !exists {
+		s = make(chan struct{}, size)
+		slots[key] = s
+	}
+	return s
+}
+
+// acquireSlot takes one of the MAX_CONCURRENT slots for the domain of the
+// request and the configured cgi dir without waiting. It returns a
+// function that releases the slot and false if there is no free slot.
+func acquireSlot(r *http.Request, cgiDir string, c Config) (func(), bool) {
+	limit, _ := c.getInt("MAX_CONCURRENT")
+	if limit <= 0 {
+		return func() {}, true
+	}
+	s := getSlots(getDomainForRequest(r), cgiDir, limit)
+	select {
+	case s <- struct{}{}:
+		return func() { <-s }, true
+	default:
+		return nil, false
+	}
+}
+
+// rateBucket is the token bucket of a script for RATE_LIMIT
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateBuckets are the token buckets by script path
+var rateBuckets = make(map[string]*rateBucket)
+var rateBucketsMutex sync.Mutex
+
+// rateAllowed takes a token from the bucket of the script. The bucket
+// is refilled with RATE_LIMIT tokens per second up to RATE_BURST tokens.
+// It returns false if the bucket is empty.
+func rateAllowed(script string, c Config) bool {
+	rate, _ := c.getInt("RATE_LIMIT")
+	if rate <= 0 {
+		return true
+	}
+	burst, _ := c.getInt("RATE_BURST")
+	if burst <= 0 {
+		burst = rate
+	}
+	rateBucketsMutex.Lock()
+	defer rateBucketsMutex.Unlock()
+	t := now()
+	b, exists := rateBuckets[script]
+	if !exists {
+		b = &rateBucket{tokens: float64(burst), last: t}
+		rateBuckets[script] = b
+	}
+	b.tokens += t.Sub(b.last).Seconds() * float64(rate)
+	b.tokens = min(b.tokens, float64(burst))
+	b.last = t
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// breakerState is the circuit breaker state of a script
+type breakerState struct {
+	failures    int
+	lastFailure time.Time
+	openUntil   time.Time
+}
+
+// breakers are the circuit breaker states by script path
+var breakers = make(map[string]*breakerState)
+var breakersMutex sync.Mutex
+
+// breakerOpen informs if the circuit breaker of a script is open, ie: the
+// script failed BREAKER_THRESHOLD times and the cooldown did not pass yet.
+func breakerOpen(script string, c Config) bool {
+	threshold, _ := c.getInt("BREAKER_THRESHOLD")
+	if threshold <= 0 {
+		return false
+	}
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	b, exists := breakers[script]
+	return exists && now().Before(b.openUntil)
+}
+
+// breakerRecord records the result of a script execution. Failures
+// within BREAKER_COOLDOWN of the previous one are counted as consecutive
+// and a success resets the breaker.
+func breakerRecord(script string, ok bool, c Config) {
+	threshold, _ := c.getInt("BREAKER_THRESHOLD")
+	if threshold <= 0 {
+		return
+	}
+	cooldown, _ := c.getDuration("BREAKER_COOLDOWN")
+	if cooldown <= 0 {
+		cooldown = DEFAULT_BREAKER_COOLDOWN
+	}
+	breakersMutex.Lock()
+	defer breakersMutex.Unlock()
+	if ok {
+		delete(breakers, script)
+		return
+	}
+	b, exists := breakers[script]
+	if !exists {
+		b = &breakerState{}
+		breakers[script] = b
+	}
+	t := now()
+	if t.Sub(b.lastFailure) > cooldown {
+		b.failures = 0
+	}
+	b.failures++
+	b.lastFailure = t
+	if b.failures >= threshold {
+		b.openUntil = t.Add(cooldown)
+	}
+}
+
+// accessLogWriter records the status and the size of a response
+// for the access log.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (aw *accessLogWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessLogWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += n
+	return n, err
+}
+
+// Unwrap is used by http.ResponseController
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+var accessLogMutex sync.Mutex
+
+// writeAccessLog writes the request to the ACCESS_LOG file, or to stdout,
+// in the common log format. The query string is only logged with
+// LOG_QUERY_STRING as it may have sensitive data.
+func writeAccessLog(path string, r *http.Request, aw *accessLogWriter, c Config) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" {
+		host = "-"
+	}
+	user, _, ok := r.BasicAuth()
+	if !ok || user == "" {
+		user = "-"
+	}
+	size := "-"
+	if aw.bytes > 0 {
+		size = strconv.Itoa(aw.bytes)
+	}
+	uri := r.URL.RequestURI()
+	logQuery, _ := c.getBool("LOG_QUERY_STRING")
+	if !logQuery {
+		uri, _, _ = strings.Cut(uri, "?")
+	}
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s\n", host, user,
+		now().Format("02/Jan/2006:15:04:05 -0700"), r.Method, uri,
+		r.Proto, aw.status, size)
+
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	if path == "stdout" {
+		os.Stdout.WriteString(line)
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	defer f.Close()
+	f.WriteString(line)
+}
+
+// timingWriter adds the X-CGI-Duration header with the time in
+// milliseconds since start when the response header is written.
+type timingWriter struct {
+	http.ResponseWriter
+	start       time.Time
+	wroteHeader bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		ms := float64(now().Sub(tw.start)) / float64(time.Millisecond)
+		tw.Header().Set("X-CGI-Duration", strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+// Unwrap is used by http.ResponseController
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// writeExecError writes the error response for a failed cgi execution.
+func writeExecError(w http.ResponseWriter, err error, c Config) {
+	log.Println(err.Error())
+	if errors.Is(err, CgiTimeoutError) || errors.Is(err, HeaderTimeoutError) {
+		WriteCgiError(w, http.StatusGatewayTimeout, c)
+		return
+	}
+	if errors.Is(err, InvalidContentTypeError) {
+		WriteCgiError(w, http.StatusBadGateway, c)
+		return
+	}
+	var stderrErr *stderrError
+	if errors.As(err, &stderrErr) {
+		http.Error(w, INTERNAL_SERVER_ERROR_MSG+"\n\n"+stderrErr.stderr,
+			http.StatusInternalServerError)
+		return
+	}
+	WriteCgiError(w, http.StatusInternalServerError, c)
+}
+
+// errorMessages are the texts of the error responses without a page
+// in ERROR_PAGES.
+var errorMessages = map[int]string{
+	http.StatusBadRequest:                  "Bad request",
+	http.StatusUnauthorized:                "Unauthorized",
+	http.StatusForbidden:                   "Forbidden",
+	http.StatusNotFound:                    "NOT FOUND",
+	http.StatusRequestTimeout:              "Request timeout",
+	http.StatusMethodNotAllowed:            "Method not allowed",
+	http.StatusUnsupportedMediaType:        "Unsupported media type",
+	http.StatusRequestURITooLong:           "URI too long",
+	http.StatusRequestHeaderFieldsTooLarge: "Too many headers",
+	http.StatusTooManyRequests:             "Too many requests",
+	http.StatusInternalServerError:         INTERNAL_SERVER_ERROR_MSG,
+	http.StatusBadGateway:                  "Bad gateway",
+	http.StatusServiceUnavailable:          "Service unavailable",
+	http.StatusGatewayTimeout:              "Gateway timeout",
+}
+
+// WriteCgiError writes an error response. The body is the page configured
+// for the status in ERROR_PAGES or a default text.
+func WriteCgiError(w http.ResponseWriter, status int, cfg map[string]any) {
+	pages, _ := Config(cfg).getStringMap("ERROR_PAGES")
+	if path := pages[strconv.Itoa(status)]; path != "" {
+		content, err := os.ReadFile(path)
+		if err == nil {
+			w.Header().Del("Content-Length")
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(status)
+			w.Write(content)
+			return
+		}
+		log.Println(err.Error())
+	}
+	msg, exists := errorMessages[status]
+	if !exists {
+		msg = http.StatusText(status)
+	}
+	http.Error(w, msg, status)
+}
+
+// flushWriter flushes the writes to the client. With an interval the
+// writes are flushed at most once by interval, otherwise after each write.
+type flushWriter struct {
+	w        http.ResponseWriter
+	rc       *http.ResponseController
+	interval time.Duration
+	mutex    sync.Mutex
+	timer    *time.Timer
+	stopped  bool
+}
+
+func newFlushWriter(w http.ResponseWriter, interval time.Duration) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w), interval: interval}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if fw.interval <= 0 {
+		fw.rc.Flush()
+	} else if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+	}
+	return n, nil
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	if fw.stopped {
+		return // notest
+	}
+	fw.rc.Flush()
+	fw.timer = nil
+}
+
+// stop flushes the pending writes. The writer must not be used after it.
+func (fw *flushWriter) stop() {
+	fw.mutex.Lock()
+	defer fw.mutex.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+		fw.rc.Flush()
+	}
+}
+
+// writeStream writes body to w flushing by interval or, if interval is
+// zero, after each write.
+func writeStream(w http.ResponseWriter, body io.Reader, interval time.Duration) error {
+	fw := newFlushWriter(w, interval)
+	defer fw.stop()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			_, werr := fw.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// getStatus returns the response status code from the cgi headers.
+// The Status header may have a reason phrase. A response without Status
+// and with Location is a redirect, see rfc3875 section 6.2.4.
+func getStatus(headers http.Header) (int, error) {
+	sts := headers.Get("Status")
+	if _, exists := headers["Status"]; !exists {
+		if headers.Get("Location") != "" {
+			return http.StatusFound, nil
+		}
+		return 0, InvalidCgiResponse
+	}
+	code, _, _ := strings.Cut(strings.TrimSpace(sts), " ")
+	stsInt, err := strconv.Atoi(code)
+	if err != nil {
+		return 0, InvalidCgiResponse
+	}
+	return stsInt, nil
+}
+
+// checkContentType checks the Content-Type sent by the cgi. An invalid
+// media type is dropped from the headers or, if INVALID_CONTENT_TYPE is
+// error, an InvalidContentTypeError is returned.
+func checkContentType(headers http.Header, c Config) error {
+	ct := headers.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+	_, _, err := mime.ParseMediaType(ct)
+	if err == nil {
+		return nil
+	}
+	mode, _ := c.getString("INVALID_CONTENT_TYPE")
+	if mode == "error" {
+		return fmt.Errorf("%w: %q", InvalidContentTypeError, ct)
+	}
+	log.Printf("[tupi-cgi] Dropping invalid Content-Type %q", ct)
+	headers.Del("Content-Type")
+	return nil
+}
+
+// setResponseHeaders sets the response headers from the cgi headers
+// and the config. It must be called before the response header is written.
+func setResponseHeaders(w http.ResponseWriter, headers http.Header,
+	m *map[string]string, c Config) {
+	allowed, _ := c.getStringList("ALLOWED_RESPONSE_HEADERS")
+	copyHeaders(w, allowedHeaders(headers, allowed))
+	addHeaders(w, c)
+	charset, _ := c.getString("DEFAULT_CHARSET")
+	addCharset(w, charset)
+	extensions, _ := c.getStringList("FORCE_DOWNLOAD_EXTENSIONS")
+	forceDownload(w, (*m)["SCRIPT_NAME"]+(*m)["PATH_INFO"], extensions)
+}
+
+// forceDownload sets Content-Disposition to attachment if the request
+// path ends with one of the extensions and the cgi did not set it.
+func forceDownload(w http.ResponseWriter, path string, extensions []string) {
+	if w.Header().Get("Content-Disposition") != "" {
+		return
+	}
+	for _, ext := range extensions {
+		if strings.HasSuffix(strings.ToLower(path), strings.ToLower(ext)) {
+			w.Header().Set("Content-Disposition", "attachment")
+			return
+		}
+	}
+}
+
+// addCharset appends the charset to text content types without one.
+func addCharset(w http.ResponseWriter, charset string) {
+	ct := w.Header().Get("Content-Type")
+	if charset == "" || ct == "" {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil || !strings.HasPrefix(mediaType, "text/") || params["charset"] != "" {
+		return
+	}
+	w.Header().Set("Content-Type", ct+"; charset="+charset)
+}
+
+// allowedHeaders returns the cgi headers present in allowed. If allowed
+// is empty all the headers are returned. Content-Encoding is always
+// returned, the body sent by the cgi can't be read without it.
+func allowedHeaders(headers http.Header, allowed []string) http.Header {
+	if len(allowed) == 0 {
+		return headers
+	}
+	filtered := make(http.Header, len(allowed)+1)
+	if values := headers.Values("Content-Encoding"); len(values) > 0 {
+		filtered["Content-Encoding"] = values
+	}
+	for _, a := range allowed {
+		if values := headers.Values(a); len(values) > 0 {
+			filtered[http.CanonicalHeaderKey(a)] = values
+		}
+	}
+	return filtered
+}
+
+// fixContentLength replaces a Content-Length set by the cgi that does not
+// match the length of the body. Responses to HEAD and 204 or 304 responses
+// have no body, so their Content-Length is left as the cgi set it.
+func fixContentLength(w http.ResponseWriter, r *http.Request, status int,
+	length int) {
+	if r.Method == http.MethodHead || status == http.StatusNoContent ||
+		status == http.StatusNotModified {
+		return
+	}
+	declared := w.Header().Get("Content-Length")
+	if declared == "" {
+		return
+	}
+	actual := strconv.Itoa(length)
+	if declared != actual {
+		log.Printf("[tupi-cgi] Content-Length mismatch: declared %s, got %s",
+			declared, actual)
+		w.Header().Set("Content-Length", actual)
+	}
+}
+
+// addHeaders adds the headers from ADD_HEADERS to the response. Headers
+// set by the cgi are only replaced if FORCE_HEADERS is true.
+func addHeaders(w http.ResponseWriter, c Config) {
+	extra, _ := c.getStringMap("ADD_HEADERS")
+	force, _ := c.getBool("FORCE_HEADERS")
+	for k, v := range extra {
+		if force || w.Header().Get(k) == "" {
+			w.Header().Set(k, v)
+		}
+	}
+}
+
+// copyHeaders copies the cgi headers to the response. The Status
+// pseudo-header is the status code of the response, not a header.
+func copyHeaders(w http.ResponseWriter, headers http.Header) {
+	for k, values := range headers {
+		if k == "Status" {
+			continue
+		}
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+func isNewLine(s string) bool {
+	if s == "\n" || s == "\n\r" || s == "\r" || s == "\r\n" || s == "" {
+		return true
+	}
+	return false
+}
+
+// parseCgiResponse parses a buffered cgi response. The header names are
+// canonicalized and repeated headers keep all their values.
+func parseCgiResponse(response *[]byte) (http.Header, *[]byte, error) {
+	br := bufio.NewReader(bytes.NewReader(*response))
+	headers, err := readCgiHeaders(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the body is copied so it does not share memory
+	// with the response and is safe to retain.
+	body, _ := io.ReadAll(br)
+	return headers, &body, nil
+}
+
+// ParseResponse parses a cgi response. It returns the response headers,
+// a reader for the response body and the response status code. The Status
+// header is not included in the returned headers.
+func ParseResponse(r io.Reader) (http.Header, io.Reader, int, error) {
+	br := bufio.NewReader(r)
+	headers, err := readCgiHeaders(br)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	status, err := getStatus(headers)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	headers.Del("Status")
+	return headers, br, status, nil
+}
+
+// readCgiHeaders reads the header block of a cgi response. The reader
+// is left at the start of the response body.
+func readCgiHeaders(br *bufio.Reader) (http.Header, error) {
+	headers := make(http.Header)
+	// scripts written on windows may start the output with a bom.
+	if bom, _ := br.Peek(len(utf8BOM)); bytes.Equal(bom, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, InvalidCgiResponse
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if isNewLine(line) {
+			return headers, nil
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 {
+			return nil, InvalidCgiResponse
+		}
+		headers.Add(strings.Trim(parts[0], " "), strings.Trim(parts[1], " "))
+	}
+}
+
+// BuildEnv returns the environment a cgi script gets for a request. The
+// environment is sorted. The config is a plain map so it can be called
+// through plugin.Lookup.
+func BuildEnv(r *http.Request, cfg map[string]any) ([]string, error) {
+	c := Config(cfg)
+	m, err := getMetaVars(r, c)
+	if err != nil {
+		return nil, err
+	}
+	return getEnv(&m, c), nil
+}
+
+// getEnv returns the environment for the cgi script. The environment of
+// the server is not inherited by the script.
+func getEnv(m *map[string]string, c Config) []string {
+	meta := (*m)
+	cgiPath, _ := c.getString("CGI_PATH")
+	if cgiPath == "" {
+		cgiPath = DEFAULT_CGI_PATH
+	}
+	env := make([]string, 0, len(meta)+1)
+	for k, v := range meta {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+	env = append(env, "PATH="+cgiPath)
+	sort.Strings(env)
+	return env
+}
+
+// getArgs returns the command line arguments for the cgi script. With
+// PATH_INFO_AS_ARGS the segments of the path info are the first arguments
+// and the arguments from the query string follow them.
+func getArgs(m *map[string]string, c Config) []string {
+	pathInfoAsArgs, _ := c.getBool("PATH_INFO_AS_ARGS")
+	var args []string
+	if pathInfoAsArgs {
+		for _, segment := range strings.Split((*m)["PATH_INFO"], "/") {
+			if segment != "" {
+				args = append(args, segment)
+			}
+		}
+	}
+	return append(args, getQueryArgs(m, c)...)
+}
+
+// getQueryArgs returns the command line arguments from the query string.
+// When ISINDEX_ARGS is true and the query string has no "=" it is split
+// on "+" and the decoded parts are the arguments, see rfc3875 section 4.4.
+// Otherwise, with QUERY_AS_ARG, the raw query string is the only argument.
+func getQueryArgs(m *map[string]string, c Config) []string {
+	isindex, _ := c.getBool("ISINDEX_ARGS")
+	queryAsArg, _ := c.getBool("QUERY_AS_ARG")
+	query := (*m)["QUERY_STRING"]
+	if query == "" || strings.Contains(query, "=") {
+		return nil
+	}
+	if !isindex {
+		if queryAsArg {
+			return []string{query}
+		}
+		return nil
+	}
+	parts := strings.Split(query, "+")
+	args := make([]string, 0, len(parts))
+	for _, p := range parts {
+		arg, err := url.QueryUnescape(p)
+		if err != nil {
+			return nil
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// newCmd returns the command to run the cgi script. The script is
+// killed when ctx is done.
+func newCmd(ctx context.Context, m *map[string]string, c Config, stdin io.Reader) *exec.Cmd {
+	meta := (*m)
+	cmdPath := meta["SCRIPT_FILENAME"]
+	chroot, _ := c.getBool("CHROOT")
+	if chroot {
+		m = chrootMetaVars(meta, c)
+	}
+	script := (*m)["SCRIPT_FILENAME"]
+	args := getArgs(m, c)
+	interpreters, _ := c.getStringMap("INTERPRETERS")
+	if interpreter := interpreters[filepath.Ext(script)]; interpreter != "" {
+		args = append([]string{script}, args...)
+		script = interpreter
+	}
+	cmd := exec.CommandContext(ctx, script, args...)
+	cmd.Env = getEnv(m, c)
+	loadDotenv, _ := c.getBool("LOAD_DOTENV")
+	if loadDotenv {
+		cmd.Env = mergeDotenv(cmd.Env, filepath.Join(filepath.Dir(cmdPath), ".env"))
+	}
+	if chroot {
+		cgiDir, _ := c.getString("CGI_DIR")
+		root, _ := filepath.Abs(cgiDir)
+		setChroot(cmd, root, c)
+	}
+	cmd.Stderr = &scriptStderr{script: cmdPath, c: c, secrets: getSecrets(m, c)}
+	cmd.Stdin = stdin
+	setKillGrace(cmd, c)
+	return cmd
+}
+
+// dotenvVarName are the valid names for vars from dotenv files
+var dotenvVarName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// mergeDotenv adds the vars in the dotenv file at path to env. The vars
+// already in env are not replaced. Blank lines, comments and lines without
+// a valid var are ignored.
+func mergeDotenv(env []string, path string) []string {
+	f, err := fs.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println(err.Error()) // notest
+		}
+		return env
+	}
+	defer f.Close()
+	exists := make(map[string]bool, len(env))
+	for _, e := range env {
+		name, _, _ := strings.Cut(e, "=")
+		exists[name] = true
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "export ")
+		name, value, found := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !found || exists[name] || !dotenvVarName.MatchString(name) {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') &&
+			value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env = append(env, name+"="+value)
+		exists[name] = true
+	}
+	sort.Strings(env)
+	return env
+}
+
+// setKillGrace makes the command get a SIGTERM when its context is done
+// and a SIGKILL after KILL_GRACE, so the script can clean up. Without
+// KILL_GRACE the script is killed at once.
+func setKillGrace(cmd *exec.Cmd, c Config) {
+	grace, _ := c.getDuration("KILL_GRACE")
+	if grace <= 0 {
+		return
+	}
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
 	}
+	cmd.WaitDelay = grace
+}
 
-	cgiDir, ok := d.(string)
-	if !ok {
-		return BadCgiDirError
+// chrootMetaVars returns a copy of the meta vars with the file system
+// paths relative to the cgi dir, the root of the scripts with CHROOT.
+func chrootMetaVars(meta map[string]string, c Config) *map[string]string {
+	cgiDir, _ := c.getString("CGI_DIR")
+	chrootMeta := make(map[string]string, len(meta))
+	for k, v := range meta {
+		chrootMeta[k] = v
 	}
+	chrootMeta["SCRIPT_FILENAME"] = scriptName(cgiDir, meta["SCRIPT_FILENAME"])
+	if meta["PATH_TRANSLATED"] != "" {
+		chrootMeta["PATH_TRANSLATED"] = meta["PATH_INFO"]
+	}
+	return &chrootMeta
+}
 
-	_, err := os.Stat(cgiDir)
-	return err
+// maxStderrTail is how much of the end of the stderr of a script is
+// kept to be sent to the client with DEBUG_STDERR.
+const maxStderrTail = 64 * 1024
 
+// scriptStderr writes the stderr of a script line by line, as the
+// script writes it, to the STDERR_LOG file or to the log. Only the
+// last maxStderrTail bytes are kept for DEBUG_STDERR.
+type scriptStderr struct {
+	script  string
+	c       Config
+	secrets []string
+	partial []byte
+	tail    []byte
 }
 
-func Serve(w http.ResponseWriter, r *http.Request, conf *map[string]any) {
-	c := (*conf)
-	d, _ := c["CGI_DIR"]
-	cgiDir, _ := d.(string)
+// Write logs the complete lines in p and keeps the incomplete one
+// until the rest of it is written.
+func (s *scriptStderr) Write(p []byte) (int, error) {
+	if debug, _ := s.c.getBool("DEBUG_STDERR"); debug {
+		s.tail = append(s.tail, p...)
+		if len(s.tail) > maxStderrTail {
+			s.tail = s.tail[len(s.tail)-maxStderrTail:]
+		}
+	}
+	s.partial = append(s.partial, p...)
+	i := bytes.LastIndexByte(s.partial, '\n')
+	if i < 0 {
+		if len(s.partial) >= maxStderrTail {
+			s.writeLines(string(s.partial))
+			s.partial = nil
+		}
+		return len(p), nil
+	}
+	s.writeLines(string(s.partial[:i]))
+	s.partial = append([]byte(nil), s.partial[i+1:]...)
+	return len(p), nil
+}
 
-	m, err := getMetaVars(r, cgiDir)
-	if err != nil {
-		log.Printf(err.Error())
-		http.Error(w, INTERNAL_SERVER_ERROR_MSG, 500)
-		return
+// getSecrets returns the values of the meta vars in REDACT_ENV.
+func getSecrets(m *map[string]string, c Config) []string {
+	redact, _ := c.getStringList("REDACT_ENV")
+	secrets := make([]string, 0, len(redact))
+	for _, k := range redact {
+		if v := (*m)[k]; v != "" {
+			secrets = append(secrets, v)
+		}
 	}
-	if m["SCRIPT_NAME"] == "" {
-		http.Error(w, "NOT FOUND", http.StatusNotFound)
-		return
+	return secrets
+}
+
+// redact replaces the secrets in s with ***.
+func redact(s string, secrets []string) string {
+	if len(secrets) == 0 {
+		return s
 	}
-	var rawBody []byte = nil
-	if r.ContentLength > 0 && r.Body != nil {
-		defer r.Body.Close()
-		rawBody, err = io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "Bad request", 400)
-			return
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, "***")
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+var stderrLogMutex sync.Mutex
+
+// writeLines writes the lines in output to the STDERR_LOG file or to
+// the log if STDERR_LOG is not configured. The values of the vars in
+// REDACT_ENV are replaced by ***.
+func (s *scriptStderr) writeLines(output string) {
+	output = redact(output, s.secrets)
+	lines := strings.Split(output, "\n")
+	path, _ := s.c.getString("STDERR_LOG")
+	if path == "" {
+		for _, line := range lines {
+			log.Printf("[tupi-cgi] %s stderr: %s", s.script, line)
 		}
+		return
 	}
-	output, err := execCmd(&m, &rawBody)
+
+	stderrLogMutex.Lock()
+	defer stderrLogMutex.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Println(err.Error())
-		http.Error(w, INTERNAL_SERVER_ERROR_MSG, http.StatusInternalServerError)
+		for _, line := range lines {
+			log.Printf("[tupi-cgi] %s stderr: %s", s.script, line)
+		}
 		return
 	}
-	var headers *map[string]string
-	var body *[]byte
-	headers, body, err = parseCgiResponse(output)
-	if headers == nil {
-		http.Error(w, INTERNAL_SERVER_ERROR_MSG, http.StatusInternalServerError)
-		return
+	defer f.Close()
+	ts := now().Format(time.RFC3339)
+	for _, line := range lines {
+		fmt.Fprintf(f, "%s %s: %s\n", ts, s.script, line)
 	}
-	h := (*headers)
-	sts, exits := h["Status"]
-	if !exits {
-		http.Error(w, INTERNAL_SERVER_ERROR_MSG, http.StatusInternalServerError)
+}
+
+// flush writes the last line of the stderr if the script exited
+// without ending it with a newline.
+func (s *scriptStderr) flush() {
+	if len(s.partial) == 0 {
 		return
 	}
-	stsInt, err := strconv.Atoi(sts)
-	if err != nil {
-		http.Error(w, INTERNAL_SERVER_ERROR_MSG, http.StatusInternalServerError)
+	s.writeLines(string(s.partial))
+	s.partial = nil
+}
+
+// stderrError is the error of a script with its stderr, sent to the
+// client with DEBUG_STDERR.
+type stderrError struct {
+	err    error
+	stderr string
+}
+
+func (e *stderrError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stderrError) Unwrap() error {
+	return e.err
+}
+
+// withStderr adds the stderr of the script to err if DEBUG_STDERR is
+// true. The values of the vars in REDACT_ENV are replaced by ***.
+func withStderr(cmd *exec.Cmd, err error) error {
+	stderr, ok := cmd.Stderr.(*scriptStderr)
+	if err == nil || !ok {
+		return err
 	}
+	debug, _ := stderr.c.getBool("DEBUG_STDERR")
+	if !debug {
+		return err
+	}
+	return &stderrError{err: err, stderr: redact(string(stderr.tail), stderr.secrets)}
+}
 
-	for k, v := range *headers {
-		w.Header().Add(k, v)
+// flushStderr logs the stderr of a script that exited.
+func flushStderr(cmd *exec.Cmd) {
+	stderr, ok := cmd.Stderr.(*scriptStderr)
+	if ok {
+		stderr.flush()
 	}
-	w.WriteHeader(stsInt)
-	w.Write([]byte(*body))
 }
 
-func isNewLine(s string) bool {
-	if s == "\n" || s == "\n\r" || s == "\r" || s == "\r\n" || s == "" {
-		return true
+// checkEnvVars checks that the environment of the command does not have
+// more than MAX_ENV_VARS vars, so the exec does not fail with E2BIG.
+func checkEnvVars(cmd *exec.Cmd, c Config) error {
+	maxVars, _ := c.getInt("MAX_ENV_VARS")
+	if maxVars > 0 && len(cmd.Env) > maxVars {
+		return fmt.Errorf("%w: %s has %d vars", TooManyEnvVarsError, cmd.Path,
+			len(cmd.Env))
 	}
-	return false
+	return nil
 }
 
-func parseCgiResponse(response *[]byte) (*map[string]string, *[]byte, error) {
-	headers := make(map[string]string, 0)
-	body := make([]byte, 0)
-	delim := byte('\n')
-	previousDelim := 0
-	for i, b := range *response {
-		if b == delim {
-			line := string((*response)[previousDelim:i])
-			if isNewLine(line) {
-				body = (*response)[i+1:]
-				return &headers, &body, nil
-			}
-			previousDelim = i + 1
-			line = strings.Trim(line, "\n")
-			parts := strings.Split(line, ":")
-			headers[strings.Trim(parts[0], " ")] = strings.Trim(parts[1], " ")
+// canUseShell informs if a script that could not be executed must be
+// run again with DEFAULT_SHELL, ie: the script has no shebang.
+func canUseShell(err error, c Config) bool {
+	shell, _ := c.getString("DEFAULT_SHELL")
+	return shell != "" && errors.Is(err, syscall.ENOEXEC)
+}
 
-		}
+// shellCmd returns a command that runs the script of cmd with
+// DEFAULT_SHELL. The returned command has no stdout set.
+func shellCmd(ctx context.Context, cmd *exec.Cmd, c Config) *exec.Cmd {
+	shell, _ := c.getString("DEFAULT_SHELL")
+	args := append([]string{cmd.Path}, cmd.Args[1:]...)
+	sh := exec.CommandContext(ctx, shell, args...)
+	sh.Env = cmd.Env
+	sh.Stdin = cmd.Stdin
+	sh.Stderr = cmd.Stderr
+	sh.ExtraFiles = cmd.ExtraFiles
+	sh.SysProcAttr = cmd.SysProcAttr
+	sh.Dir = cmd.Dir
+	setKillGrace(sh, c)
+	return sh
+}
+
+// maxPooledBuffer is the capacity above which a buffer is not
+// returned to the pool so big responses are not retained.
+const maxPooledBuffer = 1 << 20
+
+// outputPool holds the buffers used to read the output of the scripts
+var outputPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getOutputBuffer() *bytes.Buffer {
+	return outputPool.Get().(*bytes.Buffer)
+}
+
+// putOutputBuffer returns a buffer to the pool. The buffer must not be
+// used after that.
+func putOutputBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
 	}
-	return nil, nil, InvalidCgiResponse
+	buf.Reset()
+	outputPool.Put(buf)
 }
 
-func execCmd(m *map[string]string, rawBody *[]byte) (*[]byte, error) {
-	meta := (*m)
-	envVars := make([]string, 15)
-	for k, v := range meta {
-		envVar := fmt.Sprintf("%s=%s", k, v)
-		envVars = append(envVars, envVar)
+// bodyReader returns a reader for the request body read by Serve, or nil
+// if the request has no body, so the script stdin is the null device.
+func bodyReader(rawBody []byte) io.Reader {
+	if rawBody == nil {
+		return nil
+	}
+	return bytes.NewReader(rawBody)
+}
+
+// startCmd starts the cgi script and returns its stdout. The extra files
+// are passed to the script starting at the file descriptor 3. The caller
+// must read stdout until EOF and then call waitCmd.
+func startCmd(ctx context.Context, m *map[string]string, c Config, stdin io.Reader,
+	extra ...*os.File) (*exec.Cmd, io.ReadCloser, error) {
+	cmd := newCmd(ctx, m, c, stdin)
+	err := checkEnvVars(cmd, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd.ExtraFiles = extra
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err // notest
+	}
+	err = cmd.Start()
+	if canUseShell(err, c) {
+		cmd = shellCmd(ctx, cmd, c)
+		stdout, err = cmd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err // notest
+		}
+		err = cmd.Start()
 	}
-	cmdPath := meta["SCRIPT_NAME"]
-	cmd := exec.Command(cmdPath)
-	cmdEnv := append(cmd.Env, envVars...)
-	cmd.Env = cmdEnv
-	if rawBody != nil {
-		cmd.Stdin = bytes.NewReader(*rawBody)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, nil, fmt.Errorf("%w: %s", CgiTimeoutError, cmd.Path)
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return nil, nil, fmt.Errorf("%w: %s", NotExecutableError, cmd.Path)
+		}
+		return nil, nil, err
 	}
-	o, err := cmd.CombinedOutput()
-	return &o, err
+	return cmd, stdout, nil
+}
 
+// waitCmd waits for a command started by startCmd to exit.
+func waitCmd(ctx context.Context, cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	flushStderr(cmd)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %s", CgiTimeoutError, cmd.Path)
+	}
+	return withStderr(cmd, err)
 }
 
-func getMetaVars(r *http.Request, cgiDir string) (map[string]string, error) {
-	headers := []string{
-		"Auth-Type",
-		"Remote-User",
-		"Content-Type",
-		"Server-Software",
+func getMetaVars(r *http.Request, c Config) (map[string]string, error) {
+	err := validateRequestPath(r)
+	if err != nil {
+		return nil, err
 	}
+	d, _ := c["CGI_DIR"]
+	cgiDir, _ := d.(string)
+	strip, _ := c.getStringList("STRIP_HEADERS")
 	meta := make(map[string]string)
 
-	for _, h := range headers {
+	for _, h := range metaHeaders {
 		rHeader := r.Header.Get(h)
 		if rHeader != "" {
-			meta[strings.ReplaceAll(strings.ToUpper(h), "-", "_")] = rHeader
+			meta[headerToMetaVar(h)] = rHeader
+		}
+	}
+
+	envPrefix, _ := c.getString("TRUST_ENV_HEADERS")
+	strict, _ := c.getBool("STRICT_HEADER_NAMES")
+	firstOnly, _ := c.getBool("FIRST_HEADER_ONLY")
+	for k, v := range getHTTPHeaders(r, strip, firstOnly) {
+		if envPrefix != "" && hasPrefixFold(k, envPrefix) {
+			continue
+		}
+		name := headerToMetaVar(k)
+		if strict {
+			var ok bool
+			name, ok = strictHeaderToMetaVar(k)
+			if !ok {
+				continue
+			}
 		}
+		meta["HTTP_"+name] = v
 	}
 
+	index, _ := c.getString("INDEX_SCRIPT")
+	extensions, _ := c.getStringList("TRY_EXTENSIONS")
 	path := r.URL.Path
-	scriptPath, pathInfo := findScript(cgiDir, path)
+	collapse, _ := c.getBool("COLLAPSE_SLASHES")
+	if collapse {
+		path = collapseSlashes(path)
+	}
+	scriptPath, pathInfo := findScript(cgiDir, path, index, extensions)
+	if scriptPath == "" {
+		if fallback := getFallbackScript(cgiDir, path, c); fallback != "" {
+			scriptPath, pathInfo = fallback, path
+		}
+	}
 	pathTranslated := ""
 
 	if pathInfo != "" {
@@ -187,32 +2331,275 @@ func getMetaVars(r *http.Request, cgiDir string) (map[string]string, error) {
 	}
 	query := r.URL.RawQuery
 
-	meta["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	// CONTENT_LENGTH must be unset when there is no message body,
+	// see rfc3875 section 4.1.2. Chunked requests have an unknown length
+	// and the script reads stdin until eof. Bodies that are not sent to
+	// the script, ie: of GET requests, have no length either.
+	if r.ContentLength > 0 && hasBody(r) {
+		meta["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
 	meta["GATEWAY_INTERFACE"] = "CGI/1.1"
-	meta["PATH_INFO"] = pathInfo
-	meta["PATH_TRANSLATED"] = pathTranslated
-	meta["SCRIPT_NAME"] = scriptPath
+	omitEmpty, _ := c.getBool("OMIT_EMPTY_PATH_INFO")
+	if pathInfo != "" || !omitEmpty {
+		meta["PATH_INFO"] = pathInfo
+		meta["PATH_TRANSLATED"] = pathTranslated
+	}
+	// SCRIPT_NAME is the url path of the script, see rfc3875 section
+	// 4.1.13. The file system path goes in SCRIPT_FILENAME.
+	meta["SCRIPT_NAME"] = scriptName(cgiDir, scriptPath)
+	meta["SCRIPT_FILENAME"] = scriptPath
 	meta["QUERY_STRING"] = query
-	meta["REMOTE_ADDR"] = getIp(r)
-	meta["REQUEST_METHOD"] = r.Method
+	meta["REMOTE_ADDR"] = getIp(r, c)
+	meta["REQUEST_METHOD"] = getRequestMethod(r, c)
 	meta["SERVER_NAME"] = getDomainForRequest(r)
-	port, err := getPortForRequest(r)
+	port, err := getPortForRequest(r, c)
 	if err != nil {
 		return nil, err
 	}
 	meta["SERVER_PORT"] = strconv.Itoa(port)
 	meta["SERVER_PROTOCOL"] = r.Proto
+	// scripts that only know HTTP/1.x may reject newer protocols
+	downgrade, _ := c.getBool("DOWNGRADE_PROTOCOL")
+	if downgrade && r.ProtoMajor > 1 {
+		meta["SERVER_PROTOCOL"] = "HTTP/1.1"
+	}
+	meta["REQUEST_SCHEME"] = getSchemeForRequest(r, c)
+	if envPrefix != "" {
+		allowed, _ := c.getStringList("TRUST_ENV_NAMES")
+		setEnvHeaders(r, envPrefix, allowed, meta)
+	}
 
 	return meta, nil
 }
 
+// envVarName are the valid names for vars from TRUST_ENV_HEADERS
+var envVarName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// reservedEnvVars are the vars never set by TRUST_ENV_HEADERS: the cgi
+// meta-variables, even if a request doesn't have them, and the vars that
+// change how programs are loaded or shells start.
+var reservedEnvVars = map[string]bool{
+	"AUTH_TYPE":         true,
+	"CONTENT_LENGTH":    true,
+	"CONTENT_TYPE":      true,
+	"GATEWAY_INTERFACE": true,
+	"PATH_INFO":         true,
+	"PATH_TRANSLATED":   true,
+	"QUERY_STRING":      true,
+	"REMOTE_ADDR":       true,
+	"REMOTE_HOST":       true,
+	"REMOTE_IDENT":      true,
+	"REMOTE_USER":       true,
+	"REQUEST_METHOD":    true,
+	"REQUEST_SCHEME":    true,
+	"SCRIPT_NAME":       true,
+	"SCRIPT_FILENAME":   true,
+	"SERVER_NAME":       true,
+	"SERVER_PORT":       true,
+	"SERVER_PROTOCOL":   true,
+	"SERVER_SOFTWARE":   true,
+	"CGI_BODY_FILE":     true,
+	"PATH":              true,
+	"BASH_ENV":          true,
+	"ENV":               true,
+}
+
+// isReservedEnvVar informs if name is a var that can't be set by
+// TRUST_ENV_HEADERS. HTTP_ vars come only from the request headers, so
+// STRIP_HEADERS and the httpoxy protection can't be bypassed.
+func isReservedEnvVar(name string) bool {
+	return reservedEnvVars[name] || strings.HasPrefix(name, "HTTP_") ||
+		strings.HasPrefix(name, "LD_")
+}
+
+// setEnvHeaders sets the vars from the headers starting with prefix,
+// ie: X-CGI-Env-Foo: bar sets FOO=bar. The vars already in meta and the
+// reserved vars are not set and invalid names are ignored. If allowed is
+// not empty only the vars in it are set.
+func setEnvHeaders(r *http.Request, prefix string, allowed []string,
+	meta map[string]string) {
+	for k, v := range r.Header {
+		if !hasPrefixFold(k, prefix) {
+			continue
+		}
+		name := headerToMetaVar(k[len(prefix):])
+		if _, exists := meta[name]; exists || isReservedEnvVar(name) ||
+			!envVarName.MatchString(name) {
+			continue
+		}
+		if len(allowed) > 0 && !slices.Contains(allowed, name) {
+			continue
+		}
+		meta[name] = strings.Join(v, ", ")
+	}
+}
+
+func hasPrefixFold(s string, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// collapseSlashes replaces the repeated slashes in path by one slash.
+func collapseSlashes(path string) string {
+	var b strings.Builder
+	b.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] == '/' && i > 0 && path[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// scriptName returns the url path for a script in the cgi dir.
+func scriptName(cgiDir string, scriptPath string) string {
+	if scriptPath == "" {
+		return ""
+	}
+	name := filepath.ToSlash(strings.TrimPrefix(scriptPath, cgiDir))
+	return "/" + strings.TrimLeft(name, "/")
+}
+
+// validateRequestPath checks that the request path has no malformed
+// percent-encoding.
+func validateRequestPath(r *http.Request) error {
+	raw := r.URL.RawPath
+	if r.RequestURI != "" {
+		raw, _, _ = strings.Cut(r.RequestURI, "?")
+	}
+	_, err := url.PathUnescape(raw)
+	if err != nil {
+		return fmt.Errorf("%w: %s", BadRequestPathError, err.Error())
+	}
+	return nil
+}
+
+func headerToMetaVar(h string) string {
+	return strings.ReplaceAll(strings.ToUpper(h), "-", "_")
+}
+
+// strictHeaderToMetaVar converts a header name to a var name replacing
+// anything that is not a letter or a digit by an underscore. It returns
+// false for names with control, space or non ascii characters, that
+// can't be in a var name.
+func strictHeaderToMetaVar(h string) (string, bool) {
+	name := make([]byte, 0, len(h))
+	for i := 0; i < len(h); i++ {
+		ch := h[i]
+		switch {
+		case ch >= 'a' && ch <= 'z':
+			name = append(name, ch-'a'+'A')
+		case ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+			name = append(name, ch)
+		case ch > ' ' && ch < 0x7f && ch != '=':
+			name = append(name, '_')
+		default:
+			return "", false
+		}
+	}
+	return string(name), len(name) > 0
+}
+
+// getHTTPHeaders returns the request headers that must be sent to the cgi
+// as HTTP_ variables, see rfc3875 section 4.1.18. The values of a header
+// sent more than once are joined, unless firstOnly is true.
+func getHTTPHeaders(r *http.Request, strip []string, firstOnly bool) map[string]string {
+	skip := make(map[string]bool)
+	for _, h := range metaHeaders {
+		skip[h] = true
+	}
+	for _, h := range strip {
+		skip[http.CanonicalHeaderKey(h)] = true
+	}
+	// Content-Length is already sent as CONTENT_LENGTH and Proxy
+	// must never be sent because of httpoxy.
+	skip["Content-Length"] = true
+	skip["Proxy"] = true
+
+	headers := make(map[string]string)
+	if r.Host != "" && !skip["Host"] {
+		headers["Host"] = r.Host
+	}
+	for k, v := range r.Header {
+		k = http.CanonicalHeaderKey(k)
+		// hand built requests may have headers without values
+		if skip[k] || len(v) == 0 {
+			continue
+		}
+		sep := ", "
+		if k == "Cookie" {
+			sep = "; "
+		} else if firstOnly {
+			v = v[:1]
+		}
+		headers[k] = strings.Join(v, sep)
+	}
+	return headers
+}
+
+// getDomainForRequest returns the lowercased host of the request. A fully
+// qualified host, ie: example.com., is the same domain without the
+// trailing dot.
 func getDomainForRequest(req *http.Request) string {
 	domain := strings.Split(req.Host, ":")[0]
 	domain = strings.ToLower(domain)
+	domain = strings.TrimSuffix(domain, ".")
 	return domain
 }
 
-func getPortForRequest(r *http.Request) (int, error) {
+// methodName are the valid methods for X-HTTP-Method-Override, the
+// token chars from rfc9110 section 5.6.2
+var methodName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+// getRequestMethod returns the method of the request. With METHOD_OVERRIDE
+// the X-HTTP-Method-Override header of POST requests takes precedence.
+func getRequestMethod(r *http.Request, c Config) string {
+	override, _ := c.getBool("METHOD_OVERRIDE")
+	if !override || r.Method != http.MethodPost {
+		return r.Method
+	}
+	method := strings.TrimSpace(r.Header.Get("X-HTTP-Method-Override"))
+	if !methodName.MatchString(method) {
+		return r.Method
+	}
+	return strings.ToUpper(method)
+}
+
+// getSchemeForRequest returns the scheme the client used, http or https.
+// With TRUST_FORWARDED_HEADERS, X-Forwarded-Proto takes precedence.
+func getSchemeForRequest(r *http.Request, c Config) string {
+	trustForwarded, _ := c.getBool("TRUST_FORWARDED_HEADERS")
+	if trustForwarded {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		proto = strings.ToLower(strings.TrimSpace(proto))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if r.URL.Scheme != "" {
+		return strings.ToLower(r.URL.Scheme)
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// getPortForRequest returns the port the client connected to. PUBLIC_PORT
+// and, with TRUST_FORWARDED_HEADERS, X-Forwarded-Port take precedence
+// over the request host.
+func getPortForRequest(r *http.Request, c Config) (int, error) {
+	publicPort, _ := c.getInt("PUBLIC_PORT")
+	if publicPort > 0 {
+		return publicPort, nil
+	}
+	trustForwarded, _ := c.getBool("TRUST_FORWARDED_HEADERS")
+	if forwarded := r.Header.Get("X-Forwarded-Port"); trustForwarded && forwarded != "" {
+		port, err := strconv.Atoi(forwarded)
+		if err == nil && port > 0 && port < 65536 {
+			return port, nil
+		}
+	}
 	hostParts := strings.Split(r.Host, ":")
 	if len(hostParts) == 2 {
 		return strconv.Atoi(hostParts[1])
@@ -225,11 +2612,231 @@ func getPortForRequest(r *http.Request) (int, error) {
 	return 443, nil
 }
 
-func getIp(req *http.Request) string {
-	return req.RemoteAddr
+// getIp returns the address of the client. Connections over unix sockets
+// have no client address and UNIX_REMOTE_ADDR is used.
+func getIp(req *http.Request, c Config) string {
+	if req.RemoteAddr != "" && req.RemoteAddr != "@" {
+		return req.RemoteAddr
+	}
+	addr, _ := c.getString("UNIX_REMOTE_ADDR")
+	if addr == "" {
+		addr = DEFAULT_UNIX_REMOTE_ADDR
+	}
+	return addr
+}
+
+// setRequestId sends the request id to the cgi and echoes it in the
+// response. If the request has no id and GENERATE_REQUEST_ID is true a new
+// id is created.
+func setRequestId(w http.ResponseWriter, r *http.Request, m map[string]string, c Config) {
+	header, _ := c.getString("REQUEST_ID_HEADER")
+	if header == "" {
+		header = DEFAULT_REQUEST_ID_HEADER
+	}
+	id := r.Header.Get(header)
+	generate, _ := c.getBool("GENERATE_REQUEST_ID")
+	if id == "" && generate {
+		id = newUUID()
+	}
+	if id == "" {
+		return
+	}
+	m["HTTP_"+headerToMetaVar(header)] = id
+	w.Header().Set(header, id)
+}
+
+// newUUID returns a random (version 4) uuid.
+func newUUID() string {
+	u := make([]byte, 16)
+	rand.Read(u)
+	u[6] = (u[6] & 0x0f) | 0x40
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// readBody reads the request body. If timeout is not zero and the body
+// is not read before it, ReadTimeoutError is returned. The timeout is a
+// read deadline on the connection, so it is not used with writers that
+// don't support it.
+func readBody(w http.ResponseWriter, body io.Reader, timeout time.Duration) ([]byte, error) {
+	if timeout > 0 {
+		rc := http.NewResponseController(w)
+		err := rc.SetReadDeadline(time.Now().Add(timeout))
+		if err == nil {
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+	b, err := io.ReadAll(body)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %s", ReadTimeoutError, timeout)
+	}
+	return b, err
+}
+
+// hasBody informs if the request body must be sent to the cgi. Methods
+// not in methodsWithoutBody or methodsWithBody have the body sent when
+// the request has a content length.
+func hasBody(r *http.Request) bool {
+	if r.Body == nil || methodsWithoutBody[r.Method] {
+		return false
+	}
+	if methodsWithBody[r.Method] {
+		return true
+	}
+	return r.ContentLength > 0
+}
+
+// getTimeout returns the execution timeout for a script. A timeout in
+// SCRIPT_TIMEOUTS whose key matches the script name overrides CGI_TIMEOUT.
+// The keys may be glob patterns.
+func getTimeout(script string, c Config) time.Duration {
+	timeout, _ := c.getDuration("CGI_TIMEOUT")
+	overrides, _ := c.getDurationMap("SCRIPT_TIMEOUTS")
+	if p, matched := matchScript(script, overrides); matched {
+		return overrides[p]
+	}
+	return timeout
+}
+
+// contentTypeAllowed informs if the request content type is one of the
+// content types in REQUIRE_CONTENT_TYPE for the script.
+func contentTypeAllowed(script string, contentType string, c Config) bool {
+	required, _ := c.getStringListMap("REQUIRE_CONTENT_TYPE")
+	p, matched := matchScript(script, required)
+	if !matched {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range required[p] {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchScript returns the key of m that matches the script name. The keys
+// may be glob patterns and an exact match is preferred.
+func matchScript[V any](script string, m map[string]V) (string, bool) {
+	name := filepath.Base(script)
+	if _, exists := m[name]; exists {
+		return name, true
+	}
+	patterns := make([]string, 0, len(m))
+	for p := range m {
+		patterns = append(patterns, p)
+	}
+	sort.Strings(patterns)
+	for _, p := range patterns {
+		matched, _ := filepath.Match(p, name)
+		if matched {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// methodAllowed informs if the request method is allowed for the script
+// by SCRIPT_METHODS. It returns the allowed methods too.
+func methodAllowed(script string, method string, c Config) (bool, []string) {
+	methods, _ := c.getStringListMap("SCRIPT_METHODS")
+	p, matched := matchScript(script, methods)
+	if !matched {
+		return true, nil
+	}
+	for _, m := range methods[p] {
+		if strings.EqualFold(m, method) {
+			return true, nil
+		}
+	}
+	return false, methods[p]
+}
+
+// parsePrefix parses a cidr, ie: 10.0.0.0/8, or an ip address, that is
+// a prefix with only itself.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	return netip.ParsePrefix(s)
+}
+
+// checkIpAllow checks the networks in SCRIPT_IP_ALLOW.
+func checkIpAllow(c Config) error {
+	allow, _ := c.getStringListMap("SCRIPT_IP_ALLOW")
+	for _, networks := range allow {
+		for _, n := range networks {
+			_, err := parsePrefix(n)
+			if err != nil {
+				return fmt.Errorf("%w: SCRIPT_IP_ALLOW %s", BadConfigValueError, n)
+			}
+		}
+	}
+	return nil
+}
+
+// ipAllowed informs if the client address may run the script, ie: it
+// is in one of the networks of the script in SCRIPT_IP_ALLOW. Scripts
+// not in SCRIPT_IP_ALLOW can be run from any address.
+func ipAllowed(script string, remoteAddr string, c Config) bool {
+	allow, _ := c.getStringListMap("SCRIPT_IP_ALLOW")
+	p, matched := matchScript(script, allow)
+	if !matched {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, n := range allow[p] {
+		prefix, err := parsePrefix(n)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// countPathSegments returns the number of non empty segments in path.
+func countPathSegments(path string) int {
+	n := 0
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// isDirRequest informs if the request was for a directory without
+// the trailing slash and the index script was used.
+func isDirRequest(r *http.Request, m map[string]string, index string) bool {
+	p := r.URL.Path
+	if index == "" || m["PATH_INFO"] != "" || strings.HasSuffix(p, "/") {
+		return false
+	}
+	return filepath.Base(p) != index && filepath.Base(m["SCRIPT_FILENAME"]) == index
 }
 
-func findScript(cgiDir string, path string) (string, string) {
+// findScript returns the script path and the path info for a
+// request path. If the script path is a directory and index is not
+// empty the index script in the directory is used. When a path segment
+// does not exist the segment with each one of the extensions is tried.
+// Paths with symlink loops and directories without an index script
+// return an empty script path.
+func findScript(cgiDir string, path string, index string, extensions []string) (string, string) {
 	if containsDotDot(path) {
 		return "", ""
 	}
@@ -242,18 +2849,71 @@ func findScript(cgiDir string, path string) (string, string) {
 			continue
 		}
 		testPath := scriptPath + string(os.PathSeparator) + p
-		_, err := os.Stat(testPath)
+		_, err := fs.Stat(testPath)
 		if err == nil {
 			scriptPath = testPath
 			continue
 		}
+		// symlink loops are not followed, the kernel limits the
+		// resolution and returns ELOOP.
+		if errors.Is(err, syscall.ELOOP) {
+			return "", ""
+		}
+		extPath := tryExtensions(testPath, extensions)
+		if extPath != "" {
+			scriptPath = extPath
+			continue
+		}
 		pathInfo = "/" + strings.Join(pathparts[i:], string(os.PathSeparator))
 		break
 	}
-	if scriptPath == cgiDir {
-		scriptPath = ""
+	// the root of the cgi dir is only served by its index script. The
+	// paths are cleaned so "." segments or a trailing separator don't
+	// hide the root.
+	if filepath.Clean(scriptPath) == filepath.Clean(cgiDir) && pathInfo != "" {
+		return "", pathInfo
+	}
+	info, err := fs.Stat(scriptPath)
+	if err != nil || !info.IsDir() {
+		return scriptPath, pathInfo
+	}
+	// a directory is only served by its index script
+	if index != "" {
+		indexPath := filepath.Join(scriptPath, index)
+		_, err = fs.Stat(indexPath)
+		if err == nil {
+			return indexPath, pathInfo
+		}
+	}
+	return "", pathInfo
+}
+
+// tryExtensions returns the first existing path made of path plus
+// one of the extensions.
+func tryExtensions(path string, extensions []string) string {
+	for _, ext := range extensions {
+		_, err := fs.Stat(path + ext)
+		if err == nil {
+			return path + ext
+		}
+	}
+	return ""
+}
+
+// getFallbackScript returns the path of FALLBACK_SCRIPT, the script
+// for the requests that don't match a script. It returns "" if the fallback
+// is not set or does not exist.
+func getFallbackScript(cgiDir string, path string, c Config) string {
+	fallback, _ := c.getString("FALLBACK_SCRIPT")
+	if fallback == "" || containsDotDot(path) || containsDotDot(fallback) {
+		return ""
+	}
+	scriptPath := cgiDir + string(os.PathSeparator) + strings.TrimLeft(fallback, "/")
+	info, err := fs.Stat(scriptPath)
+	if err != nil || info.IsDir() {
+		return ""
 	}
-	return scriptPath, pathInfo
+	return scriptPath
 }
 
 func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
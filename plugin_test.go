@@ -18,18 +18,45 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 type ErrBody int
 
+// writeScript writes an executable script to path
+func writeScript(t *testing.T, path string, content string) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(content), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func (ErrBody) Read(p []byte) (int, error) {
 	return 0, errors.New("some error")
 }
@@ -56,6 +83,352 @@ func TestInit_BadConfs(t *testing.T) {
 			"cgi dir does not exist",
 			map[string]any{"CGI_DIR": "./dont-exist"},
 			os.ErrNotExist},
+		{
+			"bad strip headers",
+			map[string]any{"CGI_DIR": "./build", "STRIP_HEADERS": "Cookie"},
+			BadConfigValueError},
+		{
+			"bad index script",
+			map[string]any{"CGI_DIR": "./build", "INDEX_SCRIPT": 1},
+			BadConfigValueError},
+		{
+			"bad dir redirect",
+			map[string]any{"CGI_DIR": "./build", "DIR_REDIRECT": "yes"},
+			BadConfigValueError},
+		{
+			"bad cgi timeout",
+			map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": "1s"},
+			BadConfigValueError},
+		{
+			"bad require auth",
+			map[string]any{"CGI_DIR": "./build", "REQUIRE_AUTH": 1},
+			BadConfigValueError},
+		{
+			"bad auth realm",
+			map[string]any{"CGI_DIR": "./build", "AUTH_REALM": true},
+			BadConfigValueError},
+		{
+			"bad stream threshold",
+			map[string]any{"CGI_DIR": "./build", "STREAM_THRESHOLD": "1k"},
+			BadConfigValueError},
+		{
+			"bad cgi path",
+			map[string]any{"CGI_DIR": "./build", "CGI_PATH": []any{"/bin"}},
+			BadConfigValueError},
+		{
+			"bad debug timing",
+			map[string]any{"CGI_DIR": "./build", "DEBUG_TIMING": "true"},
+			BadConfigValueError},
+		{
+			"bad request id header",
+			map[string]any{"CGI_DIR": "./build", "REQUEST_ID_HEADER": 1},
+			BadConfigValueError},
+		{
+			"bad generate request id",
+			map[string]any{"CGI_DIR": "./build", "GENERATE_REQUEST_ID": 1},
+			BadConfigValueError},
+		{
+			"bad max path segments",
+			map[string]any{"CGI_DIR": "./build", "MAX_PATH_SEGMENTS": 1.5},
+			BadConfigValueError},
+		{
+			"bad try extensions",
+			map[string]any{"CGI_DIR": "./build", "TRY_EXTENSIONS": ".cgi"},
+			BadConfigValueError},
+		{
+			"bad add headers",
+			map[string]any{"CGI_DIR": "./build", "ADD_HEADERS": []any{"X-A"}},
+			BadConfigValueError},
+		{
+			"bad add headers value",
+			map[string]any{
+				"CGI_DIR":     "./build",
+				"ADD_HEADERS": map[string]any{"X-A": 1}},
+			BadConfigValueError},
+		{
+			"bad force headers",
+			map[string]any{"CGI_DIR": "./build", "FORCE_HEADERS": "no"},
+			BadConfigValueError},
+		{
+			"bad isindex args",
+			map[string]any{"CGI_DIR": "./build", "ISINDEX_ARGS": 1},
+			BadConfigValueError},
+		{
+			"bad script timeouts",
+			map[string]any{"CGI_DIR": "./build", "SCRIPT_TIMEOUTS": 1},
+			BadConfigValueError},
+		{
+			"bad script timeouts value",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"SCRIPT_TIMEOUTS": map[string]any{"report.cgi": "1"}},
+			BadConfigValueError},
+		{
+			"bad stderr log",
+			map[string]any{"CGI_DIR": "./build", "STDERR_LOG": 1},
+			BadConfigValueError},
+		{
+			"bad breaker threshold",
+			map[string]any{"CGI_DIR": "./build", "BREAKER_THRESHOLD": "3"},
+			BadConfigValueError},
+		{
+			"bad breaker cooldown",
+			map[string]any{"CGI_DIR": "./build", "BREAKER_COOLDOWN": "3"},
+			BadConfigValueError},
+		{
+			"bad allowed response headers",
+			map[string]any{"CGI_DIR": "./build", "ALLOWED_RESPONSE_HEADERS": "X-A"},
+			BadConfigValueError},
+		{
+			"bad default shell",
+			map[string]any{"CGI_DIR": "./build", "DEFAULT_SHELL": 1},
+			BadConfigValueError},
+		{
+			"bad script methods",
+			map[string]any{"CGI_DIR": "./build", "SCRIPT_METHODS": "POST"},
+			BadConfigValueError},
+		{
+			"bad script methods item",
+			map[string]any{
+				"CGI_DIR":        "./build",
+				"SCRIPT_METHODS": map[string]any{"hook.cgi": "POST"}},
+			BadConfigValueError},
+		{
+			"bad force close",
+			map[string]any{"CGI_DIR": "./build", "FORCE_CLOSE": "true"},
+			BadConfigValueError},
+		{
+			"bad default charset",
+			map[string]any{"CGI_DIR": "./build", "DEFAULT_CHARSET": 1},
+			BadConfigValueError},
+		{
+			"bad config file",
+			map[string]any{"CGI_DIR": "./build", "CONFIG_FILE": 1},
+			BadConfigValueError},
+		{
+			"bad stream threshold float",
+			map[string]any{"CGI_DIR": "./build", "STREAM_THRESHOLD": 1.5},
+			BadConfigValueError},
+		{
+			"bad redact env",
+			map[string]any{"CGI_DIR": "./build", "REDACT_ENV": "HTTP_COOKIE"},
+			BadConfigValueError},
+		{
+			"bad warmup cmd",
+			map[string]any{"CGI_DIR": "./build", "WARMUP_CMD": "true"},
+			BadConfigValueError},
+		{
+			"bad warmup pattern",
+			map[string]any{"CGI_DIR": "./build", "WARMUP_PATTERN": 1},
+			BadConfigValueError},
+		{
+			"bad unix remote addr",
+			map[string]any{"CGI_DIR": "./build", "UNIX_REMOTE_ADDR": 1},
+			BadConfigValueError},
+		{
+			"bad chroot",
+			map[string]any{"CGI_DIR": "./build", "CHROOT": "yes"},
+			BadConfigValueError},
+		{
+			"bad force download extensions",
+			map[string]any{"CGI_DIR": "./build", "FORCE_DOWNLOAD_EXTENSIONS": ".csv"},
+			BadConfigValueError},
+		{
+			"bad error pages",
+			map[string]any{"CGI_DIR": "./build", "ERROR_PAGES": "404.html"},
+			BadConfigValueError},
+		{
+			"bad require content type",
+			map[string]any{"CGI_DIR": "./build", "REQUIRE_CONTENT_TYPE": "application/json"},
+			BadConfigValueError},
+		{
+			"bad debug routing",
+			map[string]any{"CGI_DIR": "./build", "DEBUG_ROUTING": "true"},
+			BadConfigValueError},
+		{
+			"bad read timeout",
+			map[string]any{"CGI_DIR": "./build", "READ_TIMEOUT": "1"},
+			BadConfigValueError},
+		{
+			"bad collapse slashes",
+			map[string]any{"CGI_DIR": "./build", "COLLAPSE_SLASHES": 1},
+			BadConfigValueError},
+		{
+			"bad trust env headers",
+			map[string]any{"CGI_DIR": "./build", "TRUST_ENV_HEADERS": true},
+			BadConfigValueError},
+		{
+			"bad access log",
+			map[string]any{"CGI_DIR": "./build", "ACCESS_LOG": 1},
+			BadConfigValueError},
+		{
+			"bad query as arg",
+			map[string]any{"CGI_DIR": "./build", "QUERY_AS_ARG": "true"},
+			BadConfigValueError},
+		{
+			"bad interpreters",
+			map[string]any{"CGI_DIR": "./build", "INTERPRETERS": "/bin/sh"},
+			BadConfigValueError},
+		{
+			"missing interpreters",
+			map[string]any{
+				"CGI_DIR": "./build",
+				"INTERPRETERS": map[string]any{
+					".sh": "/bin/sh",
+					".py": "/no/such/python",
+					".rb": "/no/such/ruby",
+				}},
+			MissingInterpreterError},
+		{
+			"bad max concurrent",
+			map[string]any{"CGI_DIR": "./build", "MAX_CONCURRENT": "2"},
+			BadConfigValueError},
+		{
+			"bad retry after",
+			map[string]any{"CGI_DIR": "./build", "RETRY_AFTER": "2"},
+			BadConfigValueError},
+		{
+			"bad public port",
+			map[string]any{"CGI_DIR": "./build", "PUBLIC_PORT": "443"},
+			BadConfigValueError},
+		{
+			"bad trust forwarded headers",
+			map[string]any{"CGI_DIR": "./build", "TRUST_FORWARDED_HEADERS": "true"},
+			BadConfigValueError},
+		{
+			"bad max headers",
+			map[string]any{"CGI_DIR": "./build", "MAX_HEADERS": "100"},
+			BadConfigValueError},
+		{
+			"bad strict header names",
+			map[string]any{"CGI_DIR": "./build", "STRICT_HEADER_NAMES": 1},
+			BadConfigValueError},
+		{
+			"bad rate limit",
+			map[string]any{"CGI_DIR": "./build", "RATE_LIMIT": "10"},
+			BadConfigValueError},
+		{
+			"bad rate burst",
+			map[string]any{"CGI_DIR": "./build", "RATE_BURST": 1.5},
+			BadConfigValueError},
+		{
+			"bad init timeout",
+			map[string]any{"CGI_DIR": "./build", "INIT_TIMEOUT": "1"},
+			BadConfigValueError},
+		{
+			"bad invalid content type",
+			map[string]any{"CGI_DIR": "./build", "INVALID_CONTENT_TYPE": true},
+			BadConfigValueError},
+		{
+			"bad body to file",
+			map[string]any{"CGI_DIR": "./build", "BODY_TO_FILE": "yes"},
+			BadConfigValueError},
+		{
+			"bad downgrade protocol",
+			map[string]any{"CGI_DIR": "./build", "DOWNGRADE_PROTOCOL": "true"},
+			BadConfigValueError},
+		{
+			"bad kill grace",
+			map[string]any{"CGI_DIR": "./build", "KILL_GRACE": "1s"},
+			BadConfigValueError},
+		{
+			"bad omit empty path info",
+			map[string]any{"CGI_DIR": "./build", "OMIT_EMPTY_PATH_INFO": 1},
+			BadConfigValueError},
+		{
+			"bad resolve cgi dir",
+			map[string]any{"CGI_DIR": "./build", "RESOLVE_CGI_DIR": "true"},
+			BadConfigValueError},
+		{
+			"bad debug stderr",
+			map[string]any{"CGI_DIR": "./build", "DEBUG_STDERR": "true"},
+			BadConfigValueError},
+		{
+			"bad max env vars",
+			map[string]any{"CGI_DIR": "./build", "MAX_ENV_VARS": "100"},
+			BadConfigValueError},
+		{
+			"bad status path",
+			map[string]any{"CGI_DIR": "./build", "STATUS_PATH": 1},
+			BadConfigValueError},
+		{
+			"bad load dotenv",
+			map[string]any{"CGI_DIR": "./build", "LOAD_DOTENV": "true"},
+			BadConfigValueError},
+		{
+			"bad flush interval",
+			map[string]any{"CGI_DIR": "./build", "FLUSH_INTERVAL": "1s"},
+			BadConfigValueError},
+		{
+			"bad script ip allow",
+			map[string]any{"CGI_DIR": "./build", "SCRIPT_IP_ALLOW": []any{"10.0.0.0/8"}},
+			BadConfigValueError},
+		{
+			"bad script ip allow network",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"SCRIPT_IP_ALLOW": map[string]any{"admin.cgi": []any{"10.0.0.0/33"}},
+			},
+			BadConfigValueError},
+		{
+			"bad script ip allow address",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"SCRIPT_IP_ALLOW": map[string]any{"admin.cgi": []any{"localhost"}},
+			},
+			BadConfigValueError},
+		{
+			"bad path info as args",
+			map[string]any{"CGI_DIR": "./build", "PATH_INFO_AS_ARGS": "yes"},
+			BadConfigValueError},
+		{
+			"bad method override",
+			map[string]any{"CGI_DIR": "./build", "METHOD_OVERRIDE": 1},
+			BadConfigValueError},
+		{
+			"bad full duplex",
+			map[string]any{"CGI_DIR": "./build", "FULL_DUPLEX": "true"},
+			BadConfigValueError},
+		{
+			"bad fallback script",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": true},
+			BadConfigValueError},
+		{
+			"bad header timeout",
+			map[string]any{"CGI_DIR": "./build", "HEADER_TIMEOUT": "1s"},
+			BadConfigValueError},
+		{
+			"bad log query string",
+			map[string]any{"CGI_DIR": "./build", "LOG_QUERY_STRING": "no"},
+			BadConfigValueError},
+		{
+			"bad auto etag",
+			map[string]any{"CGI_DIR": "./build", "AUTO_ETAG": 1},
+			BadConfigValueError},
+		{
+			"bad first header only",
+			map[string]any{"CGI_DIR": "./build", "FIRST_HEADER_ONLY": "true"},
+			BadConfigValueError},
+		{
+			"bad max uri length",
+			map[string]any{"CGI_DIR": "./build", "MAX_URI_LENGTH": "1k"},
+			BadConfigValueError},
+		{
+			"bad trust env names",
+			map[string]any{"CGI_DIR": "./build", "TRUST_ENV_NAMES": "FOO"},
+			BadConfigValueError},
+		{
+			"bad chroot uid",
+			map[string]any{"CGI_DIR": "./build", "CHROOT_UID": "nobody"},
+			BadConfigValueError},
+		{
+			"bad chroot gid",
+			map[string]any{"CGI_DIR": "./build", "CHROOT_GID": "nogroup"},
+			BadConfigValueError},
+		{
+			"bad strip headers item",
+			map[string]any{"CGI_DIR": "./build", "STRIP_HEADERS": []any{1}},
+			BadConfigValueError},
 	}
 
 	for _, test := range tests {
@@ -74,6 +447,23 @@ func TestInit(t *testing.T) {
 		conf map[string]any
 	}{
 		{map[string]any{"CGI_DIR": "./build"}},
+		{map[string]any{
+			"CGI_DIR":       "./build",
+			"STRIP_HEADERS": []any{"Cookie"}}},
+		{map[string]any{
+			"CGI_DIR":       "./build",
+			"STRIP_HEADERS": []string{"Cookie"}}},
+		{map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": 1}},
+		{map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": int64(1)}},
+		{map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": 0.5}},
+		{map[string]any{"CGI_DIR": "./build", "STREAM_THRESHOLD": 1024}},
+		{map[string]any{"CGI_DIR": "./build", "STREAM_THRESHOLD": int64(1024)}},
+		{map[string]any{
+			"CGI_DIR":         "./build",
+			"SCRIPT_TIMEOUTS": map[string]any{"report.cgi": 60, "*.py": 0.5}}},
+		{map[string]any{
+			"CGI_DIR":     "./build",
+			"ADD_HEADERS": map[string]string{"X-Frame-Options": "DENY"}}},
 	}
 
 	for _, test := range tests {
@@ -84,6 +474,381 @@ func TestInit(t *testing.T) {
 	}
 }
 
+// statFS is an os file system with a custom Stat
+type statFS func(name string) (os.FileInfo, error)
+
+func (f statFS) Stat(name string) (os.FileInfo, error) {
+	return f(name)
+}
+
+func (f statFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// fakeFS is an in memory file system. The paths are relative to
+// the root of the map.
+type fakeFS struct {
+	fstest.MapFS
+}
+
+func (f fakeFS) Stat(name string) (os.FileInfo, error) {
+	return f.MapFS.Stat(f.name(name))
+}
+
+func (f fakeFS) Open(name string) (io.ReadCloser, error) {
+	return f.MapFS.Open(f.name(name))
+}
+
+func (f fakeFS) name(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
+
+func TestFindScript_FakeFS(t *testing.T) {
+	defer func() { fs = osFS{} }()
+	fs = fakeFS{fstest.MapFS{
+		"cgi/app.cgi":       {Data: []byte("#!/bin/sh\n")},
+		"cgi/dir/index.cgi": {Data: []byte("#!/bin/sh\n")},
+		"cgi/empty":         {Mode: os.ModeDir},
+	}}
+
+	var testCases = []struct {
+		name       string
+		path       string
+		extensions []string
+		script     string
+		pathInfo   string
+	}{
+		{"script", "/app.cgi", nil, "/cgi/app.cgi", ""},
+		{"path info", "/app.cgi/a/b", nil, "/cgi/app.cgi", "/a/b"},
+		{"extension", "/app/a", []string{".cgi"}, "/cgi/app.cgi", "/a"},
+		{"index", "/dir", nil, "/cgi/dir/index.cgi", ""},
+		{"dir without index", "/empty", nil, "", ""},
+		{"missing", "/missing.cgi", nil, "", "/missing.cgi"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			script, pathInfo := findScript("/cgi", test.path, "index.cgi",
+				test.extensions)
+			if script != test.script || pathInfo != test.pathInfo {
+				t.Fatalf("Invalid script %q %q", script, pathInfo)
+			}
+		})
+	}
+}
+
+func TestFindScript_Root(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "index.cgi"), `#!/bin/sh
+printf "Status: 200\n\n$SCRIPT_NAME"
+`)
+
+	var testCases = []struct {
+		name   string
+		path   string
+		index  string
+		script string
+	}{
+		{"root with index", "/", "index.cgi", filepath.Join(cgiDir, "index.cgi")},
+		{"empty with index", "", "index.cgi", filepath.Join(cgiDir, "index.cgi")},
+		{"root without index", "/", "", ""},
+		{"empty without index", "", "", ""},
+		{"root with missing index", "/", "main.cgi", ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			script, pathInfo := findScript(cgiDir, test.path, test.index, nil)
+			if script != test.script || pathInfo != "" {
+				t.Fatalf("Invalid script %q %q", script, pathInfo)
+			}
+		})
+	}
+
+	conf := map[string]any{"CGI_DIR": cgiDir, "INDEX_SCRIPT": "index.cgi"}
+	r, _ := http.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK || w.Body.String() != "/index.cgi" {
+		t.Fatalf("Invalid response %d %s", w.Code, w.Body.String())
+	}
+
+	conf = map[string]any{"CGI_DIR": cgiDir}
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+}
+
+func TestFindScript_CgiDir(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "index.cgi"), `#!/bin/sh
+printf "Status: 200\n\n"
+`)
+	dirName := "/" + filepath.Base(cgiDir)
+
+	var testCases = []struct {
+		name     string
+		cgiDir   string
+		path     string
+		script   string
+		pathInfo string
+	}{
+		{"root", cgiDir, "/", filepath.Join(cgiDir, "index.cgi"), ""},
+		{"root trailing separator", cgiDir + "/", "/", cgiDir + "/index.cgi", ""},
+		{"dir name", cgiDir, dirName, "", dirName},
+		{"dir name trailing separator", cgiDir + "/", dirName, "", dirName},
+		{"dot segment", cgiDir, "/./missing", "", "/missing"},
+		{"dot dir", cgiDir + "/.", "/missing", "", "/missing"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			script, pathInfo := findScript(test.cgiDir, test.path, "index.cgi", nil)
+			if script != test.script || pathInfo != test.pathInfo {
+				t.Fatalf("Invalid script %q %q", script, pathInfo)
+			}
+		})
+	}
+}
+
+func TestInit_FakeFS(t *testing.T) {
+	defer func() { fs = osFS{} }()
+	fs = fakeFS{fstest.MapFS{
+		"cgi/app.cgi":       {Data: []byte("#!/bin/sh\n")},
+		"etc/tupi-cgi.json": {Data: []byte(`{"INDEX_SCRIPT": "app.cgi"}`)},
+		"usr/bin/php-cgi":   {Data: []byte("")},
+	}}
+
+	conf := map[string]any{"CGI_DIR": "/cgi", "CONFIG_FILE": "/etc/tupi-cgi.json"}
+	err := Init("fake.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf["INDEX_SCRIPT"] != "app.cgi" {
+		t.Fatalf("Invalid INDEX_SCRIPT %v", conf["INDEX_SCRIPT"])
+	}
+
+	conf = map[string]any{
+		"CGI_DIR":      "/cgi",
+		"INTERPRETERS": map[string]any{".php": "/usr/bin/php-cgi"},
+	}
+	err = Init("fake.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf = map[string]any{
+		"CGI_DIR":      "/cgi",
+		"INTERPRETERS": map[string]any{".py": "/usr/bin/python3"},
+	}
+	err = Init("fake.domain", &conf)
+	if !errors.Is(err, MissingInterpreterError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+
+	conf = map[string]any{"CGI_DIR": "/missing"}
+	err = Init("fake.domain", &conf)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Invalid error %v", err)
+	}
+}
+
+func TestInit_Timeout(t *testing.T) {
+	defer func() { fs = osFS{} }()
+	release := make(chan struct{})
+	defer close(release)
+	fs = statFS(func(name string) (os.FileInfo, error) {
+		if name == "./slow" {
+			<-release
+		}
+		return os.Stat(name)
+	})
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"fast stat",
+			map[string]any{"CGI_DIR": "./build", "INIT_TIMEOUT": 1},
+			nil,
+		},
+		{
+			"missing dir",
+			map[string]any{"CGI_DIR": "./missing", "INIT_TIMEOUT": 1},
+			os.ErrNotExist,
+		},
+		{
+			"slow stat",
+			map[string]any{"CGI_DIR": "./slow", "INIT_TIMEOUT": 0.05},
+			InitTimeoutError,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := Init("timeout.domain", &test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Invalid error %v", err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	emptyDir := t.TempDir()
+	conf := map[string]any{"CGI_DIR": "./build"}
+	err := Init("Reload.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func() int {
+		r, _ := http.NewRequest("GET", "/something", nil)
+		r.Host = "reload.domain:8080"
+		w := httptest.NewRecorder()
+		Serve(w, r, &conf)
+		return w.Code
+	}
+
+	if status := serve(); status != http.StatusOK {
+		t.Fatalf("Invalid status code %d", status)
+	}
+
+	newConf := map[string]any{"CGI_DIR": emptyDir}
+	err = Reload("Reload.domain", newConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := serve(); status != http.StatusNotFound {
+		t.Fatalf("Invalid status code after reload %d", status)
+	}
+	if Domains()["Reload.domain"] != emptyDir {
+		t.Fatalf("Invalid domains %+v", Domains())
+	}
+	newConf["CGI_DIR"] = "./build"
+	if status := serve(); status != http.StatusNotFound {
+		t.Fatalf("Reloaded config changed by the caller %d", status)
+	}
+
+	err = Reload("Reload.domain", map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": "1"})
+	if !errors.Is(err, BadConfigValueError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+	if status := serve(); status != http.StatusNotFound {
+		t.Fatalf("Bad config reloaded %d", status)
+	}
+
+	err = Reload("Reload.domain", nil)
+	if !errors.Is(err, MissingConfigError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+	err = Reload("unknown.domain", map[string]any{"CGI_DIR": "./build"})
+	if !errors.Is(err, UnknownDomainError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+
+	err = Init("Reload.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status := serve(); status != http.StatusOK {
+		t.Fatalf("Invalid status code after init %d", status)
+	}
+}
+
+func TestReload_ConfIdentity(t *testing.T) {
+	emptyDir := t.TempDir()
+	conf := map[string]any{"CGI_DIR": "./build"}
+	err := Init("localhost:8080", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewHandler("handler.domain", map[string]any{"CGI_DIR": "./build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tupi may pass a copy of the config to Serve
+	copied := conf
+
+	var testCases = []struct {
+		name  string
+		host  string
+		serve func(w http.ResponseWriter, r *http.Request)
+	}{
+		{
+			"domain with port",
+			"localhost:8080",
+			func(w http.ResponseWriter, r *http.Request) { Serve(w, r, &conf) },
+		},
+		{
+			"any host",
+			"other.host",
+			func(w http.ResponseWriter, r *http.Request) { Serve(w, r, &conf) },
+		},
+		{
+			"copied config",
+			"localhost:8080",
+			func(w http.ResponseWriter, r *http.Request) { Serve(w, r, &copied) },
+		},
+		{"handler", "other.host", handler.ServeHTTP},
+	}
+
+	serve := func(host string, f func(http.ResponseWriter, *http.Request)) int {
+		r, _ := http.NewRequest("GET", "/something", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		f(w, r)
+		return w.Code
+	}
+	for _, test := range testCases {
+		if status := serve(test.host, test.serve); status != http.StatusOK {
+			t.Fatalf("%s: Invalid status code %d", test.name, status)
+		}
+	}
+
+	for _, domain := range []string{"localhost:8080", "handler.domain"} {
+		err = Reload(domain, map[string]any{"CGI_DIR": emptyDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			if status := serve(test.host, test.serve); status != http.StatusNotFound {
+				t.Fatalf("Invalid status code after reload %d", status)
+			}
+		})
+	}
+}
+
+func TestDomains(t *testing.T) {
+	otherDir := t.TempDir()
+	confs := map[string]map[string]any{
+		"a.domain": {"CGI_DIR": "./build"},
+		"b.domain": {"CGI_DIR": otherDir},
+	}
+	for domain, conf := range confs {
+		err := Init(domain, &conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := Domains()
+	if d["a.domain"] != "./build" || d["b.domain"] != otherDir {
+		t.Fatalf("Bad domains %+v", d)
+	}
+
+	d["a.domain"] = "changed"
+	if Domains()["a.domain"] != "./build" {
+		t.Fatalf("Domains changed by the caller")
+	}
+}
+
 func TestGetMetaVars(t *testing.T) {
 
 	var testCases = []struct {
@@ -102,16 +867,17 @@ func TestGetMetaVars(t *testing.T) {
 			}(),
 			map[string]string{
 				"QUERY_STRING":      "",
-				"REMOTE_ADDR":       "",
+				"REMOTE_ADDR":       "unix",
 				"REQUEST_METHOD":    "GET",
 				"SERVER_NAME":       "",
 				"SERVER_PORT":       "80",
-				"SCRIPT_NAME":       "./build/something",
+				"SCRIPT_NAME":       "/something",
+				"SCRIPT_FILENAME":   "./build/something",
 				"PATH_INFO":         "",
 				"PATH_TRANSLATED":   "",
-				"CONTENT_LENGTH":    "0",
 				"GATEWAY_INTERFACE": "CGI/1.1",
 				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "http",
 				"SERVER_SOFTWARE":   "tupi",
 			},
 			nil,
@@ -126,16 +892,17 @@ func TestGetMetaVars(t *testing.T) {
 			}(),
 			map[string]string{
 				"QUERY_STRING":      "",
-				"REMOTE_ADDR":       "",
+				"REMOTE_ADDR":       "unix",
 				"REQUEST_METHOD":    "GET",
 				"SERVER_NAME":       "",
 				"SERVER_PORT":       "80",
 				"SCRIPT_NAME":       "",
+				"SCRIPT_FILENAME":   "",
 				"PATH_INFO":         "/bad.cgi",
 				"PATH_TRANSLATED":   "./build/bad.cgi",
-				"CONTENT_LENGTH":    "0",
 				"GATEWAY_INTERFACE": "CGI/1.1",
 				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "http",
 				"SERVER_SOFTWARE":   "tupi",
 			},
 			nil,
@@ -150,16 +917,17 @@ func TestGetMetaVars(t *testing.T) {
 			}(),
 			map[string]string{
 				"QUERY_STRING":      "",
-				"REMOTE_ADDR":       "",
+				"REMOTE_ADDR":       "unix",
 				"REQUEST_METHOD":    "GET",
 				"SERVER_NAME":       "",
 				"SERVER_PORT":       "443",
-				"SCRIPT_NAME":       "./build/something",
+				"SCRIPT_NAME":       "/something",
+				"SCRIPT_FILENAME":   "./build/something",
 				"PATH_INFO":         "/the/path",
 				"PATH_TRANSLATED":   "./build/the/path",
-				"CONTENT_LENGTH":    "0",
 				"GATEWAY_INTERFACE": "CGI/1.1",
 				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "https",
 				"SERVER_SOFTWARE":   "tupi",
 			},
 			nil,
@@ -174,16 +942,17 @@ func TestGetMetaVars(t *testing.T) {
 			}(),
 			map[string]string{
 				"QUERY_STRING":      "the=query&other=param",
-				"REMOTE_ADDR":       "",
+				"REMOTE_ADDR":       "unix",
 				"REQUEST_METHOD":    "GET",
 				"SERVER_NAME":       "",
 				"SERVER_PORT":       "443",
-				"SCRIPT_NAME":       "./build/something",
+				"SCRIPT_NAME":       "/something",
+				"SCRIPT_FILENAME":   "./build/something",
 				"PATH_INFO":         "",
 				"PATH_TRANSLATED":   "",
-				"CONTENT_LENGTH":    "0",
 				"GATEWAY_INTERFACE": "CGI/1.1",
 				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "https",
 				"SERVER_SOFTWARE":   "tupi",
 			},
 			nil,
@@ -198,36 +967,199 @@ func TestGetMetaVars(t *testing.T) {
 			}(),
 			map[string]string{
 				"QUERY_STRING":      "the=query&other=param",
-				"REMOTE_ADDR":       "",
+				"REMOTE_ADDR":       "unix",
 				"REQUEST_METHOD":    "GET",
 				"SERVER_NAME":       "localhost",
 				"SERVER_PORT":       "1234",
-				"SCRIPT_NAME":       "./build/something",
+				"HTTP_HOST":         "localhost:1234",
+				"SCRIPT_NAME":       "/something",
+				"SCRIPT_FILENAME":   "./build/something",
 				"PATH_INFO":         "",
 				"PATH_TRANSLATED":   "",
-				"CONTENT_LENGTH":    "0",
 				"GATEWAY_INTERFACE": "CGI/1.1",
 				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "http",
 				"SERVER_SOFTWARE":   "tupi",
 			},
 			nil,
 		},
-	}
-
-	cgiDir := "./build"
-	for _, test := range testCases {
-		t.Run(test.name, func(t *testing.T) {
-			meta, err := getMetaVars(test.r, cgiDir)
-			if err != nil && errors.Is(err, test.err) {
-				t.Fatal(err)
-			}
-
-			if !reflect.DeepEqual(meta, test.expected) {
-				t.Fatalf("Bad meta vars\n %+v\n %+v", meta, test.expected)
-			}
-		})
-	}
-}
+		{
+			"post with body",
+			func() *http.Request {
+				r, _ := http.NewRequest("POST", "/something",
+					bytes.NewBuffer([]byte("the body")))
+				r.Header.Add("Server-Software", "tupi")
+				return r
+			}(),
+			map[string]string{
+				"QUERY_STRING":      "",
+				"REMOTE_ADDR":       "unix",
+				"REQUEST_METHOD":    "POST",
+				"SERVER_NAME":       "",
+				"SERVER_PORT":       "80",
+				"SCRIPT_NAME":       "/something",
+				"SCRIPT_FILENAME":   "./build/something",
+				"PATH_INFO":         "",
+				"PATH_TRANSLATED":   "",
+				"CONTENT_LENGTH":    "8",
+				"GATEWAY_INTERFACE": "CGI/1.1",
+				"SERVER_PROTOCOL":   "HTTP/1.1",
+				"REQUEST_SCHEME":    "http",
+				"SERVER_SOFTWARE":   "tupi",
+			},
+			nil,
+		},
+	}
+
+	conf := Config{"CGI_DIR": "./build"}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			meta, err := getMetaVars(test.r, conf)
+			if err != nil && errors.Is(err, test.err) {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(meta, test.expected) {
+				t.Fatalf("Bad meta vars\n %+v\n %+v", meta, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetMetaVars_StrictHeaderNames(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		conf     Config
+		expected map[string]string
+		missing  []string
+	}{
+		{
+			"default",
+			Config{"CGI_DIR": "./build"},
+			map[string]string{
+				"HTTP_X_DOTTED.NAME": "dot",
+				"HTTP_X_SOME_THING":  "thing",
+			},
+			[]string{"HTTP_X_DOTTED_NAME"},
+		},
+		{
+			"strict",
+			Config{"CGI_DIR": "./build", "STRICT_HEADER_NAMES": true},
+			map[string]string{
+				"HTTP_X_DOTTED_NAME": "dot",
+				"HTTP_X_SOME_THING":  "thing",
+				"HTTP_X_TILDE_":      "tilde",
+			},
+			[]string{
+				"HTTP_X_DOTTED.NAME",
+				"HTTP_X_SPACE NAME",
+				"HTTP_X_SPACE_NAME",
+				"HTTP_X_EQUAL=NAME",
+				"HTTP_X_CAFÉ",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.Header["X-Dotted.name"] = []string{"dot"}
+			r.Header["X-Some-Thing"] = []string{"thing"}
+			r.Header["X-Tilde~"] = []string{"tilde"}
+			r.Header["X-Space name"] = []string{"space"}
+			r.Header["X-Equal=name"] = []string{"equal"}
+			r.Header["X-Café"] = []string{"cafe"}
+
+			meta, err := getMetaVars(r, test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range test.expected {
+				if meta[k] != v {
+					t.Fatalf("Bad %s: %s", k, meta[k])
+				}
+			}
+			for _, k := range test.missing {
+				if _, exists := meta[k]; exists {
+					t.Fatalf("%s should not be present", k)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMetaVars_HTTPHeaders(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		conf     Config
+		expected map[string]string
+		missing  []string
+	}{
+		{
+			"forward all",
+			Config{"CGI_DIR": "./build"},
+			map[string]string{
+				"HTTP_COOKIE":        "a=1; b=2",
+				"HTTP_ACCEPT":        "text/html, text/plain",
+				"HTTP_AUTHORIZATION": "Bearer xx",
+				"HTTP_HOST":          "localhost",
+			},
+			[]string{"HTTP_PROXY", "HTTP_CONTENT_TYPE", "HTTP_X_EMPTY"},
+		},
+		{
+			"strip headers",
+			Config{
+				"CGI_DIR":       "./build",
+				"STRIP_HEADERS": []any{"cookie", "Authorization"},
+			},
+			map[string]string{
+				"HTTP_ACCEPT": "text/html, text/plain",
+				"HTTP_HOST":   "localhost",
+			},
+			[]string{"HTTP_COOKIE", "HTTP_AUTHORIZATION"},
+		},
+		{
+			"first header only",
+			Config{"CGI_DIR": "./build", "FIRST_HEADER_ONLY": true},
+			map[string]string{
+				"HTTP_COOKIE":        "a=1; b=2",
+				"HTTP_ACCEPT":        "text/html",
+				"HTTP_AUTHORIZATION": "Bearer xx",
+			},
+			[]string{"HTTP_X_EMPTY"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.Host = "localhost"
+			r.Header.Add("Cookie", "a=1")
+			r.Header.Add("Cookie", "b=2")
+			r.Header.Add("Accept", "text/html")
+			r.Header.Add("Accept", "text/plain")
+			r.Header.Add("Authorization", "Bearer xx")
+			r.Header.Add("Proxy", "http://evil.proxy")
+			r.Header.Add("Content-Type", "text/plain")
+			r.Header["X-Empty"] = []string{}
+
+			meta, err := getMetaVars(r, test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range test.expected {
+				if meta[k] != v {
+					t.Fatalf("Bad %s: %s", k, meta[k])
+				}
+			}
+			for _, k := range test.missing {
+				if _, exists := meta[k]; exists {
+					t.Fatalf("%s should not be present", k)
+				}
+			}
+		})
+	}
+}
 
 func TestParseCgiResponse(t *testing.T) {
 
@@ -255,6 +1187,23 @@ func TestParseCgiResponse(t *testing.T) {
 			nil,
 			InvalidCgiResponse,
 		},
+		{
+			"header without value",
+			[]byte("Status: 200\nX-Empty:\n\nthe body"),
+			map[string]string{
+				"Status":  "200",
+				"X-Empty": "",
+			},
+			[]byte("the body"),
+			nil,
+		},
+		{
+			"header without colon",
+			[]byte("Status: 200\nX-Empty\n\nthe body"),
+			nil,
+			nil,
+			InvalidCgiResponse,
+		},
 	}
 
 	for _, test := range testCases {
@@ -267,7 +1216,7 @@ func TestParseCgiResponse(t *testing.T) {
 			if err != nil {
 				return
 			}
-			h := (*header)
+			h := headerMap(header)
 
 			if !reflect.DeepEqual(h, test.expectedHeaders) {
 				t.Fatalf("Ivalid headers\n %+v\n%+v", h, test.expectedHeaders)
@@ -282,6 +1231,124 @@ func TestParseCgiResponse(t *testing.T) {
 	}
 }
 
+func TestParseCgiResponse_Header(t *testing.T) {
+	response := []byte("status: 200\ncontent-type: text/plain\n" +
+		"set-cookie: a=1\nSet-Cookie: b=2\n\nthe body")
+	headers, _, err := parseCgiResponse(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headers.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Invalid content type %s", headers.Get("Content-Type"))
+	}
+	if headers.Get("CONTENT-TYPE") != "text/plain" {
+		t.Fatalf("Invalid content type %s", headers.Get("CONTENT-TYPE"))
+	}
+	if headers.Get("Status") != "200" {
+		t.Fatalf("Invalid status %s", headers.Get("Status"))
+	}
+	cookies := headers.Values("set-cookie")
+	if !reflect.DeepEqual(cookies, []string{"a=1", "b=2"}) {
+		t.Fatalf("Invalid cookies %+v", cookies)
+	}
+}
+
+// headerMap returns the first value of each header. The parsed cgi
+// headers were a map[string]string before.
+func headerMap(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for k := range h {
+		m[k] = h.Get(k)
+	}
+	return m
+}
+
+func TestParseResponse(t *testing.T) {
+	var testCases = []struct {
+		name            string
+		response        string
+		expectedHeaders http.Header
+		expectedBody    string
+		expectedStatus  int
+		err             error
+	}{
+		{
+			"ok response",
+			"Status: 201\ncontent-type: text/plain\nX-Some: thing\n\nthe body",
+			http.Header{
+				"Content-Type": []string{"text/plain"},
+				"X-Some":       []string{"thing"},
+			},
+			"the body",
+			201,
+			nil,
+		},
+		{
+			"without body",
+			"Status: 204\n\n",
+			http.Header{},
+			"",
+			204,
+			nil,
+		},
+		{
+			"without status",
+			"Content-Type: text/plain\n\nthe body",
+			nil,
+			"",
+			0,
+			InvalidCgiResponse,
+		},
+		{
+			"bad response",
+			"Status: 200",
+			nil,
+			"",
+			0,
+			InvalidCgiResponse,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			headers, body, status, err := ParseResponse(
+				bytes.NewReader([]byte(test.response)))
+			if !errors.Is(err, test.err) {
+				t.Fatal(err)
+			}
+			if err != nil {
+				return
+			}
+			if status != test.expectedStatus {
+				t.Fatalf("Invalid status %d", status)
+			}
+			if !reflect.DeepEqual(headers, test.expectedHeaders) {
+				t.Fatalf("Invalid headers\n %+v\n%+v", headers, test.expectedHeaders)
+			}
+			b, _ := io.ReadAll(body)
+			if string(b) != test.expectedBody {
+				t.Fatalf("Invalid body %s", b)
+			}
+		})
+	}
+}
+
+func TestParseCgiResponse_BodyIsIndependent(t *testing.T) {
+	response := []byte("Status: 200\nContent-Type: text/plain\n\nthe body")
+	headers, body, err := parseCgiResponse(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(response[len(response)-8:], []byte("xxxxxxxx"))
+	headers.Set("Status", "500")
+
+	if string(*body) != "the body" {
+		t.Fatalf("Body changed with the response %s", *body)
+	}
+}
+
 func TestServe(t *testing.T) {
 
 	type validateFn func(w *httptest.ResponseRecorder)
@@ -342,6 +1409,42 @@ func TestServe(t *testing.T) {
 				}
 			},
 		},
+		{
+			"patch request",
+			func() *http.Request {
+				r, _ := http.NewRequest("PATCH", "/something",
+					bytes.NewBuffer([]byte("the patch body")))
+				r.URL.Scheme = "http"
+				return r
+			}(),
+			func(w *httptest.ResponseRecorder) {
+				if w.Code != http.StatusOK {
+					t.Fatalf("Invalid status code %d", w.Code)
+				}
+				b := string(w.Body.Bytes())
+				if b != "method was: PATCH\nthe patch body" {
+					t.Fatalf("Invalid body %s", b)
+				}
+			},
+		},
+		{
+			"delete request with body",
+			func() *http.Request {
+				r, _ := http.NewRequest("DELETE", "/something",
+					bytes.NewBuffer([]byte("the delete body")))
+				r.URL.Scheme = "http"
+				return r
+			}(),
+			func(w *httptest.ResponseRecorder) {
+				if w.Code != http.StatusOK {
+					t.Fatalf("Invalid status code %d", w.Code)
+				}
+				b := string(w.Body.Bytes())
+				if b != "method was: DELETE\nthe delete body" {
+					t.Fatalf("Invalid body %s", b)
+				}
+			},
+		},
 		{
 			"put request",
 			func() *http.Request {
@@ -473,3 +1576,4510 @@ func TestServe(t *testing.T) {
 		})
 	}
 }
+
+func TestServe_DirRedirect(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "dir", "index.cgi"),
+		"#!/bin/sh\nprintf 'Status: 200\\nContent-Type: text/plain\\n\\nindex'\n")
+
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		path     string
+		status   int
+		location string
+	}{
+		{
+			"redirect",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+				"DIR_REDIRECT": true,
+			},
+			"/dir",
+			http.StatusMovedPermanently,
+			"/dir/",
+		},
+		{
+			"redirect with query string",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+				"DIR_REDIRECT": true,
+			},
+			"/dir?a=1",
+			http.StatusMovedPermanently,
+			"/dir/?a=1",
+		},
+		{
+			"repeated slashes",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+				"DIR_REDIRECT": true,
+			},
+			"http://localhost//dir",
+			http.StatusMovedPermanently,
+			"/dir/",
+		},
+		{
+			"trailing slash",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+				"DIR_REDIRECT": true,
+			},
+			"/dir/",
+			http.StatusOK,
+			"",
+		},
+		{
+			"index script in the path",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+				"DIR_REDIRECT": true,
+			},
+			"/dir/index.cgi",
+			http.StatusOK,
+			"",
+		},
+		{
+			"no redirect by default",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"INDEX_SCRIPT": "index.cgi",
+			},
+			"/dir",
+			http.StatusOK,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			loc := w.Header().Get("Location")
+			if loc != test.location {
+				t.Fatalf("Invalid location %s", loc)
+			}
+			if test.status == http.StatusOK && w.Body.String() != "index" {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_Timeout(t *testing.T) {
+	defer func() {
+		now = time.Now
+		execContext = context.WithDeadline
+	}()
+
+	var testCases = []struct {
+		name   string
+		setup  func()
+		status int
+	}{
+		{
+			"in time",
+			func() {},
+			http.StatusOK,
+		},
+		{
+			"deadline in the past",
+			func() {
+				now = func() time.Time {
+					return time.Now().Add(-time.Hour)
+				}
+			},
+			http.StatusGatewayTimeout,
+		},
+		{
+			"expired context",
+			func() {
+				execContext = func(ctx context.Context, d time.Time) (context.Context, context.CancelFunc) {
+					return context.WithDeadline(ctx, time.Time{})
+				}
+			},
+			http.StatusGatewayTimeout,
+		},
+	}
+
+	conf := map[string]any{"CGI_DIR": "./build", "CGI_TIMEOUT": 10}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			now = time.Now
+			execContext = context.WithDeadline
+			test.setup()
+
+			r, _ := http.NewRequest("GET", "/something", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_Unauthorized(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "private.cgi"),
+		"#!/bin/sh\nprintf 'Status: 401\\nWWW-Authenticate: Basic realm=\"script\"\\n\\n'\n")
+	writeScript(t, filepath.Join(cgiDir, "public.cgi"),
+		"#!/bin/sh\nprintf 'Status: 200\\nContent-Type: text/plain\\n\\n'\n")
+
+	var testCases = []struct {
+		name          string
+		conf          map[string]any
+		path          string
+		authorization string
+		status        int
+		authenticate  string
+	}{
+		{
+			"script driven",
+			map[string]any{"CGI_DIR": cgiDir},
+			"/private.cgi",
+			"",
+			http.StatusUnauthorized,
+			`Basic realm="script"`,
+		},
+		{
+			"gateway driven",
+			map[string]any{"CGI_DIR": cgiDir, "REQUIRE_AUTH": true},
+			"/public.cgi",
+			"",
+			http.StatusUnauthorized,
+			`Basic realm="Restricted"`,
+		},
+		{
+			"gateway driven with realm",
+			map[string]any{
+				"CGI_DIR":      cgiDir,
+				"REQUIRE_AUTH": true,
+				"AUTH_REALM":   "my realm",
+			},
+			"/public.cgi",
+			"",
+			http.StatusUnauthorized,
+			`Basic realm="my realm"`,
+		},
+		{
+			"gateway with authorization",
+			map[string]any{"CGI_DIR": cgiDir, "REQUIRE_AUTH": true},
+			"/public.cgi",
+			"Basic dXNlcjpwYXNz",
+			http.StatusOK,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			a := w.Header().Get("WWW-Authenticate")
+			if a != test.authenticate {
+				t.Fatalf("Invalid WWW-Authenticate %s", a)
+			}
+		})
+	}
+}
+
+type ErrWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (ErrWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("write error")
+}
+
+func TestServe_StreamThreshold(t *testing.T) {
+	cgiDir := t.TempDir()
+	for _, name := range []string{"something", "otherthing"} {
+		err := os.Symlink(filepath.Join(wd(t), "build", name),
+			filepath.Join(cgiDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeScript(t, filepath.Join(cgiDir, "big.cgi"), `#!/bin/sh
+printf 'Status: 200\nContent-Type: text/plain\n\n'
+head -c 5000 /dev/zero
+`)
+	writeScript(t, filepath.Join(cgiDir, "smallerror.cgi"), `#!/bin/sh
+printf 'Status: 200\nX-Some: thing\n\nbody'
+exit 1
+`)
+	writeScript(t, filepath.Join(cgiDir, "bigerror.cgi"), `#!/bin/sh
+printf 'Status: 200\nContent-Type: text/plain\n\n'
+head -c 5000 /dev/zero
+exit 1
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1024}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			Serve(w, r, &conf)
+		}))
+	defer server.Close()
+
+	var testCases = []struct {
+		name          string
+		path          string
+		status        int
+		contentLength int64
+		chunked       bool
+		bodyLen       int
+	}{
+		{"small response", "/something", http.StatusOK, 15, false, 15},
+		{"big response", "/big.cgi", http.StatusOK, -1, true, 5000},
+		{"big response with error", "/bigerror.cgi", http.StatusOK, -1, true, 5000},
+		{"small response with error", "/smallerror.cgi", http.StatusInternalServerError, -1, false, -1},
+		{"cgi error", "/otherthing?error=1", http.StatusInternalServerError, -1, false, -1},
+		{"without headers", "/otherthing?noheader=1", http.StatusInternalServerError, -1, false, -1},
+		{"without status", "/otherthing", http.StatusInternalServerError, -1, false, -1},
+		{"bad status", "/otherthing?status=bla", http.StatusInternalServerError, -1, false, -1},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != test.status {
+				t.Fatalf("Invalid status code %d", resp.StatusCode)
+			}
+			if test.bodyLen < 0 {
+				return
+			}
+			if resp.ContentLength != test.contentLength {
+				t.Fatalf("Invalid content length %d", resp.ContentLength)
+			}
+			chunked := len(resp.TransferEncoding) > 0 &&
+				resp.TransferEncoding[0] == "chunked"
+			if chunked != test.chunked {
+				t.Fatalf("Invalid transfer encoding %+v", resp.TransferEncoding)
+			}
+			if len(b) != test.bodyLen {
+				t.Fatalf("Invalid body length %d", len(b))
+			}
+		})
+	}
+}
+
+func TestServe_StreamThresholdErrors(t *testing.T) {
+	defer func() { now = time.Now }()
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "big.cgi"), `#!/bin/sh
+printf 'Status: 200\nContent-Type: text/plain\n\n'
+head -c 5000 /dev/zero
+`)
+	writeScript(t, filepath.Join(cgiDir, "slow.cgi"), `#!/bin/sh
+sleep 0.3
+printf 'Status: 200\nContent-Type: text/plain\n\n'
+`)
+
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		path   string
+		w      http.ResponseWriter
+		status int
+	}{
+		{
+			"expired before start",
+			map[string]any{
+				"CGI_DIR":          cgiDir,
+				"STREAM_THRESHOLD": 10,
+				"CGI_TIMEOUT":      1,
+			},
+			"/big.cgi",
+			httptest.NewRecorder(),
+			http.StatusGatewayTimeout,
+		},
+		{
+			"timeout reading headers",
+			map[string]any{
+				"CGI_DIR":          cgiDir,
+				"STREAM_THRESHOLD": 10,
+				"CGI_TIMEOUT":      0.05,
+			},
+			"/slow.cgi",
+			httptest.NewRecorder(),
+			http.StatusGatewayTimeout,
+		},
+		{
+			"write error",
+			map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 10},
+			"/big.cgi",
+			ErrWriter{httptest.NewRecorder()},
+			http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			now = time.Now
+			if test.name == "expired before start" {
+				now = func() time.Time { return time.Now().Add(-time.Hour) }
+			}
+			r, _ := http.NewRequest("GET", test.path, nil)
+			Serve(test.w, r, &test.conf)
+			var code int
+			switch w := test.w.(type) {
+			case *httptest.ResponseRecorder:
+				code = w.Code
+			case ErrWriter:
+				code = w.Code
+			}
+			if code != test.status {
+				t.Fatalf("Invalid status code %d", code)
+			}
+		})
+	}
+}
+
+func wd(t *testing.T) string {
+	d, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestServe_CgiPath(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		expected string
+	}{
+		{
+			"default path",
+			map[string]any{"CGI_DIR": "./build"},
+			"\nPATH=/usr/local/bin:/usr/bin:/bin\n",
+		},
+		{
+			"custom path",
+			map[string]any{"CGI_DIR": "./build", "CGI_PATH": "/opt/bin:/bin"},
+			"\nPATH=/opt/bin:/bin\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/envthing", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			b := w.Body.String()
+			if !strings.Contains(b, test.expected) {
+				t.Fatalf("PATH not in env %s", b)
+			}
+		})
+	}
+}
+
+func TestServe_DebugTiming(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		conf    map[string]any
+		present bool
+	}{
+		{
+			"disabled",
+			map[string]any{"CGI_DIR": "./build"},
+			false,
+		},
+		{
+			"enabled",
+			map[string]any{"CGI_DIR": "./build", "DEBUG_TIMING": true},
+			true,
+		},
+		{
+			"enabled streaming",
+			map[string]any{
+				"CGI_DIR":          "./build",
+				"DEBUG_TIMING":     true,
+				"STREAM_THRESHOLD": 1,
+			},
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			d, exists := w.Header()["X-Cgi-Duration"]
+			if exists != test.present {
+				t.Fatalf("Bad X-CGI-Duration %+v", w.Header())
+			}
+			if !test.present {
+				return
+			}
+			ms, err := strconv.ParseFloat(d[0], 64)
+			if err != nil || ms < 0 {
+				t.Fatalf("Bad duration %s", d[0])
+			}
+		})
+	}
+}
+
+func TestTimingWriter_WriteWithoutHeader(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &timingWriter{ResponseWriter: rec, start: now()}
+	w.Write([]byte("body"))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-CGI-Duration") == "" {
+		t.Fatalf("Bad response %d %+v", rec.Code, rec.Header())
+	}
+}
+
+func TestServe_RequestId(t *testing.T) {
+	uuidRe := regexp.MustCompile(
+		`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		header   string
+		incoming string
+		validate func(id string)
+	}{
+		{
+			"incoming id",
+			map[string]any{"CGI_DIR": "./build"},
+			"X-Request-Id",
+			"the-id",
+			func(id string) {
+				if id != "the-id" {
+					t.Fatalf("Bad id %s", id)
+				}
+			},
+		},
+		{
+			"incoming id custom header",
+			map[string]any{
+				"CGI_DIR":           "./build",
+				"REQUEST_ID_HEADER": "X-Trace-Id",
+			},
+			"X-Trace-Id",
+			"the-id",
+			func(id string) {
+				if id != "the-id" {
+					t.Fatalf("Bad id %s", id)
+				}
+			},
+		},
+		{
+			"generated id",
+			map[string]any{"CGI_DIR": "./build", "GENERATE_REQUEST_ID": true},
+			"X-Request-Id",
+			"",
+			func(id string) {
+				if !uuidRe.MatchString(id) {
+					t.Fatalf("Bad id %s", id)
+				}
+			},
+		},
+		{
+			"no id",
+			map[string]any{"CGI_DIR": "./build"},
+			"X-Request-Id",
+			"",
+			func(id string) {
+				if id != "" {
+					t.Fatalf("Bad id %s", id)
+				}
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/envthing", nil)
+			if test.incoming != "" {
+				r.Header.Set(test.header, test.incoming)
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			id := w.Header().Get(test.header)
+			test.validate(id)
+			if id == "" {
+				return
+			}
+			envVar := "\nHTTP_" + headerToMetaVar(test.header) + "=" + id + "\n"
+			if !strings.Contains(w.Body.String(), envVar) {
+				t.Fatalf("Id not sent to cgi %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_MaxPathSegments(t *testing.T) {
+	defer func() { fs = osFS{} }()
+	deepPath := "/something" + strings.Repeat("/a", 5000)
+
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		path     string
+		status   int
+		maxStats int
+	}{
+		{
+			"deep path without limit",
+			map[string]any{"CGI_DIR": "./build"},
+			deepPath,
+			http.StatusOK,
+			-1,
+		},
+		{
+			"deep path",
+			map[string]any{"CGI_DIR": "./build", "MAX_PATH_SEGMENTS": 100},
+			deepPath,
+			http.StatusRequestURITooLong,
+			0,
+		},
+		{
+			"path within limit",
+			map[string]any{"CGI_DIR": "./build", "MAX_PATH_SEGMENTS": 3},
+			"/something/a/b",
+			http.StatusOK,
+			-1,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			stats := 0
+			fs = statFS(func(name string) (os.FileInfo, error) {
+				stats++
+				return os.Stat(name)
+			})
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if test.maxStats >= 0 && stats > test.maxStats {
+				t.Fatalf("Too many stats %d", stats)
+			}
+		})
+	}
+}
+
+func TestServe_MaxURILength(t *testing.T) {
+	defer func() { fs = osFS{} }()
+	var stats int
+	fs = statFS(func(name string) (os.FileInfo, error) {
+		stats++
+		return os.Stat(name)
+	})
+	long := "/something?q=" + strings.Repeat("a", 100)
+
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		path   string
+		status int
+	}{
+		{"long uri without limit", map[string]any{"CGI_DIR": "./build"}, long, http.StatusOK},
+		{
+			"uri too long",
+			map[string]any{"CGI_DIR": "./build", "MAX_URI_LENGTH": 64},
+			long,
+			http.StatusRequestURITooLong,
+		},
+		{
+			"uri within limit",
+			map[string]any{"CGI_DIR": "./build", "MAX_URI_LENGTH": 64},
+			"/something?q=a",
+			http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			stats = 0
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Code == http.StatusRequestURITooLong && stats != 0 {
+				t.Fatalf("Invalid stats %d", stats)
+			}
+		})
+	}
+
+	// a server uses the uri sent by the client
+	conf := map[string]any{"CGI_DIR": "./build", "MAX_URI_LENGTH": 64}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			Serve(w, r, &conf)
+		}))
+	defer server.Close()
+	for path, status := range map[string]int{
+		long:             http.StatusRequestURITooLong,
+		"/something?q=a": http.StatusOK,
+	} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatalf("Invalid status code %d for %s", resp.StatusCode, path)
+		}
+	}
+}
+
+func TestServe_MaxHeaders(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		conf    map[string]any
+		headers int
+		status  int
+	}{
+		{
+			"many headers without limit",
+			map[string]any{"CGI_DIR": "./build"},
+			1000,
+			http.StatusOK,
+		},
+		{
+			"too many headers",
+			map[string]any{"CGI_DIR": "./build", "MAX_HEADERS": 100},
+			1000,
+			http.StatusRequestHeaderFieldsTooLarge,
+		},
+		{
+			"headers within limit",
+			map[string]any{"CGI_DIR": "./build", "MAX_HEADERS": 100},
+			10,
+			http.StatusOK,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			for i := 0; i < test.headers; i++ {
+				r.Header.Set("X-Header-"+strconv.Itoa(i), "value")
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_InvalidContentType(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "valid.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain; charset=utf-8\n\nthe body"
+`)
+	writeScript(t, filepath.Join(cgiDir, "invalid.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain; charset\n\nthe body"
+`)
+
+	var testCases = []struct {
+		name   string
+		script string
+		conf   map[string]any
+		status int
+		ct     string
+	}{
+		{"valid", "/valid.cgi", nil, http.StatusOK, "text/plain; charset=utf-8"},
+		{"invalid dropped", "/invalid.cgi", nil, http.StatusOK, ""},
+		{
+			"invalid dropped streaming",
+			"/invalid.cgi",
+			map[string]any{"STREAM_THRESHOLD": 1},
+			http.StatusOK,
+			"",
+		},
+		{
+			"valid with error",
+			"/valid.cgi",
+			map[string]any{"INVALID_CONTENT_TYPE": "error"},
+			http.StatusOK,
+			"text/plain; charset=utf-8",
+		},
+		{
+			"invalid with error",
+			"/invalid.cgi",
+			map[string]any{"INVALID_CONTENT_TYPE": "error"},
+			http.StatusBadGateway,
+			"text/plain; charset=utf-8",
+		},
+		{
+			"invalid with error streaming",
+			"/invalid.cgi",
+			map[string]any{"INVALID_CONTENT_TYPE": "error", "STREAM_THRESHOLD": 1},
+			http.StatusBadGateway,
+			"text/plain; charset=utf-8",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": cgiDir}
+			for k, v := range test.conf {
+				conf[k] = v
+			}
+			r, _ := http.NewRequest("GET", test.script, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if ct := w.Result().Header.Get("Content-Type"); ct != test.ct {
+				t.Fatalf("Invalid content type %q", ct)
+			}
+		})
+	}
+}
+
+func TestServe_BodyToFile(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "body.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n"
+if [ -f "$CGI_BODY_FILE" ]; then
+  echo "$CGI_BODY_FILE"
+  cat "$CGI_BODY_FILE"
+fi
+echo
+cat
+`)
+
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		fromFile bool
+	}{
+		{"stdin", map[string]any{}, false},
+		{"file", map[string]any{"BODY_TO_FILE": true}, true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("POST", "/body.cgi", strings.NewReader("the body"))
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			path, body, _ := strings.Cut(w.Body.String(), "\n")
+			if !test.fromFile {
+				if path != "" || body != "the body" {
+					t.Fatalf("Invalid body %q", w.Body.String())
+				}
+				return
+			}
+			if path == "" || body != "the body\n" {
+				t.Fatalf("Invalid body %q", w.Body.String())
+			}
+			if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("Body file not removed %v", err)
+			}
+		})
+	}
+
+	t.Run("temp file error", func(t *testing.T) {
+		t.Setenv("TMPDIR", filepath.Join(cgiDir, "missing"))
+		conf := map[string]any{"CGI_DIR": cgiDir, "BODY_TO_FILE": true}
+		r, _ := http.NewRequest("POST", "/body.cgi", strings.NewReader("the body"))
+		w := httptest.NewRecorder()
+		Serve(w, r, &conf)
+		if w.Code != http.StatusInternalServerError {
+			t.Fatalf("Invalid status code %d", w.Code)
+		}
+	})
+}
+
+func TestServe_ResolveCgiDir(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nprintf \"Status: 200\\n\\n$SCRIPT_FILENAME\"\n"
+	writeScript(t, filepath.Join(dir, "v1", "one.cgi"), script)
+	writeScript(t, filepath.Join(dir, "v2", "two.cgi"), script)
+	current := filepath.Join(dir, "current")
+	swap := func(target string) {
+		tmp := filepath.Join(dir, "tmp")
+		err := os.Symlink(filepath.Join(dir, target), tmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Rename(tmp, current)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var testCases = []struct {
+		name     string
+		target   string
+		path     string
+		conf     map[string]any
+		status   int
+		expected string
+	}{
+		{
+			"not resolved",
+			"v1",
+			"/one.cgi",
+			map[string]any{},
+			http.StatusOK,
+			filepath.Join(current, "one.cgi"),
+		},
+		{
+			"first deploy",
+			"v1",
+			"/one.cgi",
+			map[string]any{"RESOLVE_CGI_DIR": true},
+			http.StatusOK,
+			filepath.Join(dir, "v1", "one.cgi"),
+		},
+		{
+			"new deploy",
+			"v2",
+			"/two.cgi",
+			map[string]any{"RESOLVE_CGI_DIR": true},
+			http.StatusOK,
+			filepath.Join(dir, "v2", "two.cgi"),
+		},
+		{
+			"old script",
+			"v2",
+			"/one.cgi",
+			map[string]any{"RESOLVE_CGI_DIR": true},
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"missing dir",
+			"missing",
+			"/two.cgi",
+			map[string]any{"RESOLVE_CGI_DIR": true},
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			swap(test.target)
+			test.conf["CGI_DIR"] = current
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if test.expected != "" && w.Body.String() != test.expected {
+				t.Fatalf("Invalid script %s", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("counters and slots by configured dir", func(t *testing.T) {
+		if getDirStats(current).total.Load() != int64(len(testCases)) {
+			t.Fatalf("Invalid total %d", getDirStats(current).total.Load())
+		}
+		if getDirStats(filepath.Join(dir, "v2")).total.Load() != 0 {
+			t.Fatalf("Counted by resolved dir")
+		}
+		swap("v2")
+		s := getSlots("", current, 1)
+		s <- struct{}{}
+		defer func() { <-s }()
+		conf := map[string]any{
+			"CGI_DIR":         current,
+			"RESOLVE_CGI_DIR": true,
+			"MAX_CONCURRENT":  1,
+		}
+		r, _ := http.NewRequest("GET", "/two.cgi", nil)
+		w := httptest.NewRecorder()
+		Serve(w, r, &conf)
+		if w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Invalid status code %d", w.Code)
+		}
+	})
+}
+
+func TestServe_ErrorAfterHeaders(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "fail.cgi"), `#!/bin/sh
+printf 'Status: 200\nContent-Type: text/plain\n\nbody'
+exit 1
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir}
+	r, _ := http.NewRequest("GET", "/fail.cgi", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if w.Body.String() != INTERNAL_SERVER_ERROR_MSG+"\n" {
+		t.Fatalf("Invalid body %s", w.Body.String())
+	}
+}
+
+func TestServe_DebugStderr(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "fail.cgi"), `#!/bin/sh
+echo "something went wrong with $HTTP_AUTHORIZATION" >&2
+exit 1
+`)
+
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		expected string
+	}{
+		{"disabled", map[string]any{}, INTERNAL_SERVER_ERROR_MSG + "\n"},
+		{
+			"enabled",
+			map[string]any{"DEBUG_STDERR": true},
+			INTERNAL_SERVER_ERROR_MSG + "\n\nsomething went wrong with secret\n\n",
+		},
+		{
+			"enabled streaming",
+			map[string]any{"DEBUG_STDERR": true, "STREAM_THRESHOLD": 1},
+			INTERNAL_SERVER_ERROR_MSG + "\n\nsomething went wrong with secret\n\n",
+		},
+		{
+			"redacted",
+			map[string]any{
+				"DEBUG_STDERR": true,
+				"REDACT_ENV":   []any{"HTTP_AUTHORIZATION"},
+			},
+			INTERNAL_SERVER_ERROR_MSG + "\n\nsomething went wrong with ***\n\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("GET", "/fail.cgi", nil)
+			r.Header.Set("Authorization", "secret")
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Body.String() != test.expected {
+				t.Fatalf("Invalid body %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestScriptStderr_Write(t *testing.T) {
+	var logBuf bytes.Buffer
+	log.SetOutput(&logBuf)
+	defer log.SetOutput(os.Stderr)
+	s := &scriptStderr{
+		script: "a.cgi",
+		c:      Config{"DEBUG_STDERR": true},
+	}
+
+	s.Write([]byte("first line\nsecond"))
+	if !strings.Contains(logBuf.String(), "a.cgi stderr: first line") {
+		t.Fatalf("Line not logged %s", logBuf.String())
+	}
+	if strings.Contains(logBuf.String(), "second") {
+		t.Fatalf("Partial line logged %s", logBuf.String())
+	}
+	s.Write([]byte(" line"))
+	s.flush()
+	if !strings.Contains(logBuf.String(), "a.cgi stderr: second line") {
+		t.Fatalf("Last line not logged %s", logBuf.String())
+	}
+
+	logBuf.Reset()
+	s.Write(bytes.Repeat([]byte("x"), maxStderrTail))
+	if !strings.Contains(logBuf.String(), "stderr: xxx") || len(s.partial) != 0 {
+		t.Fatalf("Long line not logged")
+	}
+	if len(s.tail) != maxStderrTail || !bytes.HasSuffix(s.tail, []byte("xxx")) {
+		t.Fatalf("Bad tail len %d", len(s.tail))
+	}
+}
+
+func TestServe_MaxEnvVars(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		status int
+	}{
+		{"without limit", map[string]any{}, http.StatusOK},
+		{"within limit", map[string]any{"MAX_ENV_VARS": 100}, http.StatusOK},
+		{
+			"too many vars",
+			map[string]any{"MAX_ENV_VARS": 20},
+			http.StatusInternalServerError,
+		},
+		{
+			"too many vars streaming",
+			map[string]any{"MAX_ENV_VARS": 20, "STREAM_THRESHOLD": 1},
+			http.StatusInternalServerError,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = "./build"
+			r, _ := http.NewRequest("GET", "/something", nil)
+			for i := 0; i < 20; i++ {
+				r.Header.Set("X-Header-"+strconv.Itoa(i), "value")
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_StatusPath(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "ok.cgi"), `#!/bin/sh
+printf "Status: 200\n\n"
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "STATUS_PATH": "/__cgi_status"}
+
+	for i := 0; i < 2; i++ {
+		r, _ := http.NewRequest("GET", "/ok.cgi", nil)
+		Serve(httptest.NewRecorder(), r, &conf)
+	}
+	// the request is in flight while its body is read
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		r, _ := http.NewRequest("POST", "/ok.cgi", pr)
+		r.ContentLength = -1
+		Serve(httptest.NewRecorder(), r, &conf)
+		close(done)
+	}()
+	pw.Write([]byte("line"))
+
+	r, _ := http.NewRequest("GET", "/__cgi_status", nil)
+	r.Host = "some.domain"
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	pw.Close()
+	<-done
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Invalid content type %s", w.Header().Get("Content-Type"))
+	}
+	var status map[string]any
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]any{
+		"domain":         "some.domain",
+		"cgi_dir":        cgiDir,
+		"in_flight":      float64(1),
+		"total_requests": float64(3),
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Fatalf("Invalid status %+v", status)
+	}
+
+	r, _ = http.NewRequest("POST", "/__cgi_status", nil)
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+
+	conf = map[string]any{"CGI_DIR": cgiDir}
+	r, _ = http.NewRequest("GET", "/__cgi_status", nil)
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+}
+
+func TestServe_LoadDotenv(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "app", "env.cgi"), `#!/bin/sh
+printf "Status: 200\n\n$FOO|$QUOTED|$SINGLE|$lower|$SERVER_NAME|$PATH|$BAD"
+`)
+	writeScript(t, filepath.Join(cgiDir, "noenv.cgi"), `#!/bin/sh
+printf "Status: 200\n\n$FOO"
+`)
+	err := os.WriteFile(filepath.Join(cgiDir, "app", ".env"), []byte(`# a comment
+
+FOO=bar
+export QUOTED="a b"
+SINGLE='c d'
+lower = ok
+SERVER_NAME=evil
+PATH=/evil
+BAD
+1BAD=x
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		name     string
+		path     string
+		conf     map[string]any
+		expected string
+	}{
+		{"disabled", "/app/env.cgi", map[string]any{}, "||||localhost|/bin|"},
+		{
+			"enabled",
+			"/app/env.cgi",
+			map[string]any{"LOAD_DOTENV": true},
+			"bar|a b|c d|ok|localhost|/bin|",
+		},
+		{"without file", "/noenv.cgi", map[string]any{"LOAD_DOTENV": true}, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			test.conf["CGI_PATH"] = "/bin"
+			r, _ := http.NewRequest("GET", test.path, nil)
+			r.Host = "localhost"
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Body.String() != test.expected {
+				t.Fatalf("Invalid body %q", w.Body.String())
+			}
+		})
+	}
+}
+
+// flushRecorder is a response recorder that counts the flushes
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func TestServe_FlushInterval(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "chunks.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n"
+for i in 1 2 3 4 5; do
+  printf "chunk $i\n"
+  sleep 0.05
+done
+`)
+
+	var testCases = []struct {
+		name       string
+		conf       map[string]any
+		minFlushes int
+		maxFlushes int
+	}{
+		{"each write", map[string]any{}, 5, 6},
+		{"long interval", map[string]any{"FLUSH_INTERVAL": 10}, 1, 1},
+		{"short interval", map[string]any{"FLUSH_INTERVAL": 0.12}, 2, 4},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			test.conf["STREAM_THRESHOLD"] = 1
+			r, _ := http.NewRequest("GET", "/chunks.cgi", nil)
+			w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.flushes < test.minFlushes || w.flushes > test.maxFlushes {
+				t.Fatalf("Invalid flushes %d", w.flushes)
+			}
+			expected := "chunk 1\nchunk 2\nchunk 3\nchunk 4\nchunk 5\n"
+			if w.Body.String() != expected {
+				t.Fatalf("Invalid body %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_EventStream(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "events.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/event-stream\nContent-Length: 5\n\n"
+printf "data: first\n\n"
+sleep 0.5
+printf "data: second\n\n"
+`)
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{"CGI_DIR": cgiDir}},
+		{
+			"stream",
+			map[string]any{
+				"CGI_DIR":          cgiDir,
+				"STREAM_THRESHOLD": 1024,
+				"FLUSH_INTERVAL":   10,
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					Serve(w, r, &test.conf)
+				}))
+			defer server.Close()
+			start := time.Now()
+			resp, err := http.Get(server.URL + "/events.cgi")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.ContentLength != -1 {
+				t.Fatalf("Invalid content length %d", resp.ContentLength)
+			}
+			br := bufio.NewReader(resp.Body)
+			var events []string
+			var elapsed []time.Duration
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					break
+				}
+				if strings.HasPrefix(line, "data: ") {
+					events = append(events, strings.TrimSpace(line[6:]))
+					elapsed = append(elapsed, time.Since(start))
+				}
+			}
+			if !reflect.DeepEqual(events, []string{"first", "second"}) {
+				t.Fatalf("Invalid events %v", events)
+			}
+			if elapsed[0] >= 400*time.Millisecond || elapsed[1] < 500*time.Millisecond {
+				t.Fatalf("Events not streamed %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestServe_FullDuplex(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "echo.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n"
+while read line; do echo "echo: $line"; done
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "FULL_DUPLEX": true}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			Serve(w, r, &conf)
+		}))
+	defer server.Close()
+
+	pr, pw := io.Pipe()
+	r, _ := http.NewRequest("POST", server.URL+"/echo.cgi", pr)
+	// the response must arrive before the request body is complete
+	go pw.Write([]byte("first\n"))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status code %d", resp.StatusCode)
+	}
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "echo: first\n" {
+		t.Fatalf("Invalid line %q %v", line, err)
+	}
+	pw.Write([]byte("second\n"))
+	line, err = br.ReadString('\n')
+	if err != nil || line != "echo: second\n" {
+		t.Fatalf("Invalid line %q %v", line, err)
+	}
+	pw.Close()
+	rest, _ := io.ReadAll(br)
+	if len(rest) != 0 {
+		t.Fatalf("Invalid body %q", rest)
+	}
+}
+
+func TestServe_FullDuplexStalledClient(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "exit.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\nbye"
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "FULL_DUPLEX": true}
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			Serve(w, r, &conf)
+			close(served)
+		}))
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	// the client sends a chunk of the body and stalls
+	conn.Write([]byte("POST /exit.cgi HTTP/1.1\r\nHost: localhost\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n4\r\nsome\r\n"))
+
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve blocked by the body")
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "bye" {
+		t.Fatalf("Invalid body %q %v", body, err)
+	}
+}
+
+func TestServe_FullDuplexBodyError(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "read.cgi"), `#!/bin/sh
+cat > /dev/null
+while true; do sleep 0.05; done
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "FULL_DUPLEX": true, "CGI_TIMEOUT": 1}
+	r, _ := http.NewRequest("POST", "/read.cgi", ErrBody(0))
+	w := httptest.NewRecorder()
+	start := time.Now()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatal("Script not killed")
+	}
+}
+
+func TestBodyReader(t *testing.T) {
+	if r := bodyReader(nil); r != nil {
+		t.Fatalf("Invalid reader for no body %v", r)
+	}
+	b, _ := io.ReadAll(bodyReader([]byte("the body")))
+	if string(b) != "the body" {
+		t.Fatalf("Invalid body %s", b)
+	}
+}
+
+func TestServe_ScriptIpAllow(t *testing.T) {
+	conf := map[string]any{
+		"CGI_DIR": "./build",
+		"SCRIPT_IP_ALLOW": map[string]any{
+			"something": []any{"10.0.0.0/8", "192.168.1.10", "fd00::/8"},
+		},
+	}
+
+	var testCases = []struct {
+		name       string
+		path       string
+		remoteAddr string
+		status     int
+	}{
+		{"allowed network", "/something", "10.1.2.3:1234", http.StatusOK},
+		{"allowed ip", "/something", "192.168.1.10:1234", http.StatusOK},
+		{"allowed ipv6", "/something", "[fd00::1]:1234", http.StatusOK},
+		{"allowed mapped ipv4", "/something", "[::ffff:10.1.2.3]:1234", http.StatusOK},
+		{"denied", "/something", "192.168.1.11:1234", http.StatusForbidden},
+		{"denied unix socket", "/something", "", http.StatusForbidden},
+		{"other script", "/envthing", "192.168.1.11:1234", http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			r.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_ContentEncoding(t *testing.T) {
+	cgiDir := t.TempDir()
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(strings.Repeat("the body ", 100)))
+	zw.Close()
+	err := os.WriteFile(filepath.Join(cgiDir, "body.gz"), gz.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeScript(t, filepath.Join(cgiDir, "gzip.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\nContent-Encoding: gzip\n\n"
+cat "$(dirname "$0")/body.gz"
+`)
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{}},
+		{"streaming", map[string]any{"STREAM_THRESHOLD": 10}},
+		{
+			"not in allowed headers",
+			map[string]any{"ALLOWED_RESPONSE_HEADERS": []any{"Content-Type"}},
+		},
+		{
+			"with charset",
+			map[string]any{"DEFAULT_CHARSET": "utf-8"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("GET", "/gzip.cgi", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Content-Encoding") != "gzip" {
+				t.Fatalf("Invalid encoding %s", w.Header().Get("Content-Encoding"))
+			}
+			if !bytes.Equal(w.Body.Bytes(), gz.Bytes()) {
+				t.Fatalf("Body changed")
+			}
+		})
+	}
+}
+
+func TestServe_TryExtensions(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "app.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n$SCRIPT_FILENAME $PATH_INFO"
+`)
+
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		path   string
+		status int
+		body   string
+	}{
+		{
+			"resolved with extension",
+			map[string]any{"CGI_DIR": cgiDir, "TRY_EXTENSIONS": []any{".py", ".cgi"}},
+			"/app",
+			http.StatusOK,
+			filepath.Join(cgiDir, "app.cgi") + " ",
+		},
+		{
+			"resolved with extension and path info",
+			map[string]any{"CGI_DIR": cgiDir, "TRY_EXTENSIONS": []any{".cgi"}},
+			"/app/some/thing",
+			http.StatusOK,
+			filepath.Join(cgiDir, "app.cgi") + " /some/thing",
+		},
+		{
+			"miss",
+			map[string]any{"CGI_DIR": cgiDir, "TRY_EXTENSIONS": []any{".cgi"}},
+			"/missing",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"without try extensions",
+			map[string]any{"CGI_DIR": cgiDir},
+			"/app",
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_ExpectContinue(t *testing.T) {
+	conf := map[string]any{"CGI_DIR": "./build"}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			Serve(w, r, &conf)
+		}))
+	defer server.Close()
+
+	var testCases = []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{"accepted", "/something", http.StatusOK, "the post body"},
+		{"rejected", "/missing", http.StatusNotFound, ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			client := http.Client{
+				Transport: &http.Transport{
+					ExpectContinueTimeout: 5 * time.Second,
+				},
+			}
+			r, _ := http.NewRequest("POST", server.URL+test.path,
+				bytes.NewBuffer([]byte("the post body")))
+			r.Header.Set("Expect", "100-continue")
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Fatalf("Invalid status code %d", resp.StatusCode)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			if test.body != "" && string(b) != test.body {
+				t.Fatalf("Invalid body %s", b)
+			}
+		})
+	}
+}
+
+func TestServe_AddHeaders(t *testing.T) {
+	addHeaders := map[string]any{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Content-Type":           "text/html",
+	}
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		expected map[string]string
+	}{
+		{
+			"additive",
+			map[string]any{"CGI_DIR": "./build", "ADD_HEADERS": addHeaders},
+			map[string]string{
+				"X-Content-Type-Options": "nosniff",
+				"X-Frame-Options":        "DENY",
+				"Content-Type":           "text/plain",
+			},
+		},
+		{
+			"additive streaming",
+			map[string]any{
+				"CGI_DIR":          "./build",
+				"ADD_HEADERS":      addHeaders,
+				"STREAM_THRESHOLD": 1,
+			},
+			map[string]string{
+				"X-Content-Type-Options": "nosniff",
+				"X-Frame-Options":        "DENY",
+				"Content-Type":           "text/plain",
+			},
+		},
+		{
+			"force",
+			map[string]any{
+				"CGI_DIR":       "./build",
+				"ADD_HEADERS":   addHeaders,
+				"FORCE_HEADERS": true,
+			},
+			map[string]string{
+				"X-Content-Type-Options": "nosniff",
+				"X-Frame-Options":        "DENY",
+				"Content-Type":           "text/html",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			for k, v := range test.expected {
+				if w.Header().Get(k) != v {
+					t.Fatalf("Bad %s: %s", k, w.Header().Get(k))
+				}
+			}
+		})
+	}
+}
+
+func TestServe_MethodBody(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "cat.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n$CONTENT_LENGTH|"
+cat
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir}
+
+	var testCases = []struct {
+		method  string
+		chunked bool
+		body    string
+	}{
+		{"GET", false, "|"},
+		{"HEAD", false, "|"},
+		{"DELETE", false, "8|the body"},
+		{"DELETE", true, "|"},
+		{"POST", false, "8|the body"},
+		{"POST", true, "|the body"},
+		{"PUT", false, "8|the body"},
+		{"PUT", true, "|the body"},
+		{"PATCH", false, "8|the body"},
+		{"PATCH", true, "|the body"},
+		{"OPTIONS", false, "8|the body"},
+		{"OPTIONS", true, "|"},
+	}
+
+	for _, test := range testCases {
+		name := test.method
+		if test.chunked {
+			name += " chunked"
+		}
+		t.Run(name, func(t *testing.T) {
+			r, _ := http.NewRequest(test.method, "/cat.cgi",
+				bytes.NewBuffer([]byte("the body")))
+			if test.chunked {
+				r.ContentLength = -1
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Body.String() != test.body {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_IsindexArgs(t *testing.T) {
+	var testCases = []struct {
+		name string
+		conf map[string]any
+		path string
+		args string
+	}{
+		{
+			"isindex query",
+			map[string]any{"CGI_DIR": "./build", "ISINDEX_ARGS": true},
+			"/envthing?foo+bar+baz",
+			"args: foo bar baz\n",
+		},
+		{
+			"encoded isindex query",
+			map[string]any{"CGI_DIR": "./build", "ISINDEX_ARGS": true},
+			"/envthing?foo%20bar+baz",
+			"args: foo bar baz\n",
+		},
+		{
+			"bad encoded isindex query",
+			map[string]any{"CGI_DIR": "./build", "ISINDEX_ARGS": true},
+			"/envthing?foo%zzbar+baz",
+			"args: \n",
+		},
+		{
+			"query with =",
+			map[string]any{"CGI_DIR": "./build", "ISINDEX_ARGS": true},
+			"/envthing?foo=bar+baz",
+			"args: \n",
+		},
+		{
+			"disabled",
+			map[string]any{"CGI_DIR": "./build"},
+			"/envthing?foo+bar+baz",
+			"args: \n",
+		},
+		{
+			"path info as args",
+			map[string]any{"CGI_DIR": "./build", "PATH_INFO_AS_ARGS": true},
+			"/envthing/a/b/c",
+			"args: a b c\n",
+		},
+		{
+			"path info as args empty segments",
+			map[string]any{"CGI_DIR": "./build", "PATH_INFO_AS_ARGS": true},
+			"/envthing/a//b/",
+			"args: a b\n",
+		},
+		{
+			"path info and isindex args",
+			map[string]any{
+				"CGI_DIR":           "./build",
+				"PATH_INFO_AS_ARGS": true,
+				"ISINDEX_ARGS":      true,
+			},
+			"/envthing/a/b?foo+bar",
+			"args: a b foo bar\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if !strings.HasPrefix(w.Body.String(), test.args) {
+				t.Fatalf("Invalid args %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_ScriptTimeouts(t *testing.T) {
+	defer func() { now = time.Now }()
+	// the global timeout is already expired when the script starts
+	now = func() time.Time { return time.Now().Add(-2 * time.Second) }
+
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		path   string
+		status int
+	}{
+		{
+			"global timeout",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"CGI_TIMEOUT":     1,
+				"SCRIPT_TIMEOUTS": map[string]any{"envthing": 60},
+			},
+			"/something",
+			http.StatusGatewayTimeout,
+		},
+		{
+			"override by name",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"CGI_TIMEOUT":     1,
+				"SCRIPT_TIMEOUTS": map[string]any{"something": 60},
+			},
+			"/something",
+			http.StatusOK,
+		},
+		{
+			"override by glob",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"CGI_TIMEOUT":     1,
+				"SCRIPT_TIMEOUTS": map[string]any{"env*": 0.5, "some*": 60},
+			},
+			"/something",
+			http.StatusOK,
+		},
+		{
+			"override without global timeout",
+			map[string]any{
+				"CGI_DIR":         "./build",
+				"SCRIPT_TIMEOUTS": map[string]any{"some*": 1},
+			},
+			"/something",
+			http.StatusGatewayTimeout,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_MalformedPercentEncoding(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		requestURI string
+		rawPath    string
+		status     int
+	}{
+		{"invalid escape in request uri", "/something%zz?a=1", "", http.StatusBadRequest},
+		{"incomplete escape in request uri", "/something%2", "", http.StatusBadRequest},
+		{"invalid escape in raw path", "", "/something%zz", http.StatusBadRequest},
+		{"valid escape", "/something/a%20b?a=%zz", "", http.StatusOK},
+		{"no request uri", "", "", http.StatusOK},
+	}
+
+	conf := map[string]any{"CGI_DIR": "./build"}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.RequestURI = test.requestURI
+			r.URL.RawPath = test.rawPath
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_StderrLog(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	cgiDir := t.TempDir()
+	logDir := t.TempDir()
+	script := filepath.Join(cgiDir, "err.cgi")
+	writeScript(t, script, `#!/bin/sh
+echo "first error" >&2
+echo "second error" >&2
+printf 'Status: 200\nContent-Type: text/plain\n\nthe body'
+`)
+
+	var testCases = []struct {
+		name    string
+		conf    map[string]any
+		logFile string
+		inLog   bool
+	}{
+		{
+			"to the log",
+			map[string]any{"CGI_DIR": cgiDir},
+			"",
+			true,
+		},
+		{
+			"to a file",
+			map[string]any{
+				"CGI_DIR":    cgiDir,
+				"STDERR_LOG": filepath.Join(logDir, "stderr.log"),
+			},
+			filepath.Join(logDir, "stderr.log"),
+			false,
+		},
+		{
+			"to a file streaming",
+			map[string]any{
+				"CGI_DIR":          cgiDir,
+				"STDERR_LOG":       filepath.Join(logDir, "stream.log"),
+				"STREAM_THRESHOLD": 1,
+			},
+			filepath.Join(logDir, "stream.log"),
+			false,
+		},
+		{
+			"bad file",
+			map[string]any{
+				"CGI_DIR":    cgiDir,
+				"STDERR_LOG": filepath.Join(logDir, "missing", "stderr.log"),
+			},
+			"",
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var logBuf bytes.Buffer
+			log.SetOutput(&logBuf)
+			r, _ := http.NewRequest("GET", "/err.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK || w.Body.String() != "the body" {
+				t.Fatalf("Invalid response %d %s", w.Code, w.Body.String())
+			}
+			inLog := strings.Contains(logBuf.String(), "first error")
+			if inLog != test.inLog {
+				t.Fatalf("Bad log %s", logBuf.String())
+			}
+			if test.logFile == "" {
+				return
+			}
+			b, err := os.ReadFile(test.logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("Bad log file %s", b)
+			}
+			for i, msg := range []string{"first error", "second error"} {
+				if !strings.HasSuffix(lines[i], " "+script+": "+msg) {
+					t.Fatalf("Bad log line %s", lines[i])
+				}
+				_, err := time.Parse(time.RFC3339, strings.Split(lines[i], " ")[0])
+				if err != nil {
+					t.Fatalf("Bad timestamp %s", lines[i])
+				}
+			}
+		})
+	}
+}
+
+func TestServe_CircuitBreaker(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	current := start
+	now = func() time.Time { return current }
+
+	var steps = []struct {
+		name    string
+		conf    map[string]any
+		query   string
+		elapsed time.Duration
+		status  int
+	}{
+		{"first failure", nil, "error=1", 0, http.StatusInternalServerError},
+		{"second failure", nil, "error=1", time.Second, http.StatusInternalServerError},
+		{"open", nil, "status=200", 2 * time.Second, http.StatusServiceUnavailable},
+		{"still open", nil, "status=200", 10 * time.Second, http.StatusServiceUnavailable},
+		{"after cooldown", nil, "status=200", 12 * time.Second, http.StatusOK},
+		{"failure after reset", nil, "error=1", 13 * time.Second, http.StatusInternalServerError},
+		{"not open", nil, "status=200", 14 * time.Second, http.StatusOK},
+		{"failure outside window", nil, "error=1", 15 * time.Second, http.StatusInternalServerError},
+		{"other failure outside window", nil, "error=1", 30 * time.Second, http.StatusInternalServerError},
+		{"not open after window", nil, "status=200", 31 * time.Second, http.StatusOK},
+		{
+			"streaming failure",
+			map[string]any{"STREAM_THRESHOLD": 10},
+			"error=1",
+			40 * time.Second,
+			http.StatusInternalServerError,
+		},
+		{
+			"streaming second failure",
+			map[string]any{"STREAM_THRESHOLD": 10},
+			"error=1",
+			41 * time.Second,
+			http.StatusInternalServerError,
+		},
+		{"open after streaming", nil, "status=200", 42 * time.Second, http.StatusServiceUnavailable},
+		{
+			"disabled",
+			map[string]any{"BREAKER_THRESHOLD": 0},
+			"status=200",
+			43 * time.Second,
+			http.StatusOK,
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":           "./build",
+				"BREAKER_THRESHOLD": 2,
+				"BREAKER_COOLDOWN":  10,
+			}
+			for k, v := range step.conf {
+				conf[k] = v
+			}
+			current = start.Add(step.elapsed)
+			r, _ := http.NewRequest("GET", "/otherthing?"+step.query, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != step.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_RateLimit(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	current := start
+	now = func() time.Time { return current }
+
+	var steps = []struct {
+		name    string
+		script  string
+		elapsed time.Duration
+		status  int
+	}{
+		{"first", "/something", 0, http.StatusOK},
+		{"burst", "/something", 0, http.StatusOK},
+		{"over the limit", "/something", 0, http.StatusTooManyRequests},
+		{"other script", "/envthing", 0, http.StatusOK},
+		{"still over the limit", "/something", 400 * time.Millisecond, http.StatusTooManyRequests},
+		{"after refill", "/something", 500 * time.Millisecond, http.StatusOK},
+		{"over the limit again", "/something", 500 * time.Millisecond, http.StatusTooManyRequests},
+		{"after window", "/something", 10 * time.Second, http.StatusOK},
+		{"burst after window", "/something", 10 * time.Second, http.StatusOK},
+		{"over the limit after window", "/something", 10 * time.Second, http.StatusTooManyRequests},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":    "./build",
+				"RATE_LIMIT": 2,
+			}
+			current = start.Add(step.elapsed)
+			r, _ := http.NewRequest("GET", step.script, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != step.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestRateAllowed(t *testing.T) {
+	defer func() { now = time.Now }()
+	current := time.Now()
+	now = func() time.Time { return current }
+
+	c := Config{"RATE_LIMIT": 1, "RATE_BURST": 3}
+	for i := 0; i < 3; i++ {
+		if !rateAllowed("burst.cgi", c) {
+			t.Fatalf("Request %d not allowed", i)
+		}
+	}
+	if rateAllowed("burst.cgi", c) {
+		t.Fatal("Request over the burst allowed")
+	}
+	if !rateAllowed("burst.cgi", Config{}) {
+		t.Fatal("Request without limit not allowed")
+	}
+}
+
+func TestServe_BreakerClientCancel(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "slow.cgi"), `#!/bin/sh
+if [ "$QUERY_STRING" = "slow" ]; then
+    exec sleep 5
+fi
+printf "Status: 200\n\nok"
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "BREAKER_THRESHOLD": 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	r, _ := http.NewRequestWithContext(ctx, "GET", "/slow.cgi?slow", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+
+	r, _ = http.NewRequest("GET", "/slow.cgi", nil)
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+}
+
+func TestBreakerDefaultCooldown(t *testing.T) {
+	defer func() { now = time.Now }()
+	start := time.Now()
+	now = func() time.Time { return start }
+	conf := Config{"BREAKER_THRESHOLD": 1}
+	breakerRecord("default-cooldown", false, conf)
+	now = func() time.Time { return start.Add(DEFAULT_BREAKER_COOLDOWN - time.Second) }
+	if !breakerOpen("default-cooldown", conf) {
+		t.Fatalf("Breaker should be open")
+	}
+	now = func() time.Time { return start.Add(DEFAULT_BREAKER_COOLDOWN + time.Second) }
+	if breakerOpen("default-cooldown", conf) {
+		t.Fatalf("Breaker should be closed")
+	}
+}
+
+func TestServe_RedirectWithBody(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "moved.cgi"), `#!/bin/sh
+printf 'Status: 301\nLocation: http://example.com:8080/new\nContent-Type: text/html\n\n<a href="/new">click here</a>'
+`)
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{"CGI_DIR": cgiDir}},
+		{"streaming", map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/moved.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusMovedPermanently {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			loc := w.Header().Get("Location")
+			if loc != "http://example.com:8080/new" {
+				t.Fatalf("Invalid location %s", loc)
+			}
+			if w.Body.String() != `<a href="/new">click here</a>` {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_AllowedResponseHeaders(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "evil.cgi"), `#!/bin/sh
+printf 'Status: 200\nContent-Type: text/plain\nX-Evil: yes\n\nthe body'
+`)
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+		evil string
+	}{
+		{
+			"no allowlist",
+			map[string]any{"CGI_DIR": cgiDir},
+			"yes",
+		},
+		{
+			"allowlist",
+			map[string]any{
+				"CGI_DIR":                  cgiDir,
+				"ALLOWED_RESPONSE_HEADERS": []any{"content-type"},
+			},
+			"",
+		},
+		{
+			"allowlist streaming",
+			map[string]any{
+				"CGI_DIR":                  cgiDir,
+				"ALLOWED_RESPONSE_HEADERS": []any{"Content-Type"},
+				"STREAM_THRESHOLD":         1,
+			},
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/evil.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Content-Type") != "text/plain" {
+				t.Fatalf("Invalid content type %s", w.Header().Get("Content-Type"))
+			}
+			if w.Header().Get("X-Evil") != test.evil {
+				t.Fatalf("Invalid X-Evil %s", w.Header().Get("X-Evil"))
+			}
+			if w.Body.String() != "the body" {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestPutOutputBuffer(t *testing.T) {
+	big := bytes.NewBuffer(make([]byte, 0, maxPooledBuffer+1))
+	big.WriteString("something")
+	putOutputBuffer(big)
+	if big.Len() == 0 {
+		t.Fatalf("Big buffer should not be reset")
+	}
+
+	small := getOutputBuffer()
+	small.WriteString("something")
+	putOutputBuffer(small)
+	if small.Len() != 0 {
+		t.Fatalf("Buffer should be reset")
+	}
+}
+
+func BenchmarkServe(b *testing.B) {
+	conf := map[string]any{"CGI_DIR": "./build"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r, _ := http.NewRequest("GET", "/something", nil)
+		w := httptest.NewRecorder()
+		Serve(w, r, &conf)
+	}
+}
+
+// cgiOutput is a fixed cgi response to benchmark how the output is read.
+var cgiOutput = append(
+	[]byte("Status: 200\r\nContent-Type: text/plain\r\n\r\n"),
+	bytes.Repeat([]byte("some body "), 4096)...)
+
+func BenchmarkReadOutput(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := getOutputBuffer()
+			buf.ReadFrom(bytes.NewReader(cgiOutput))
+			putOutputBuffer(buf)
+		}
+	})
+	b.Run("read all", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			io.ReadAll(bytes.NewReader(cgiOutput))
+		}
+	})
+}
+
+func TestServe_DefaultShell(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "noshebang.cgi"), `printf 'Status: 200\nContent-Type: text/plain\n\nargs: %s' "$*"
+`)
+
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		status int
+		body   string
+	}{
+		{
+			"no default shell",
+			map[string]any{"CGI_DIR": cgiDir},
+			http.StatusInternalServerError,
+			"",
+		},
+		{
+			"default shell",
+			map[string]any{"CGI_DIR": cgiDir, "DEFAULT_SHELL": "/bin/sh"},
+			http.StatusOK,
+			"args: a b",
+		},
+		{
+			"default shell streaming",
+			map[string]any{
+				"CGI_DIR":          cgiDir,
+				"DEFAULT_SHELL":    "/bin/sh",
+				"STREAM_THRESHOLD": 1,
+			},
+			http.StatusOK,
+			"args: a b",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["ISINDEX_ARGS"] = true
+			r, _ := http.NewRequest("GET", "/noshebang.cgi?a+b", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_NotExecutable(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	cgiDir := t.TempDir()
+	script := filepath.Join(cgiDir, "noexec.cgi")
+	writeScript(t, script, `#!/bin/sh
+printf 'Status: 200\n\n'
+`)
+	err := os.Chmod(script, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		name   string
+		path   string
+		conf   map[string]any
+		status int
+		logged bool
+	}{
+		{
+			"not found",
+			"/missing.cgi",
+			map[string]any{"CGI_DIR": cgiDir},
+			http.StatusNotFound,
+			false,
+		},
+		{
+			"not executable",
+			"/noexec.cgi",
+			map[string]any{"CGI_DIR": cgiDir},
+			http.StatusInternalServerError,
+			true,
+		},
+		{
+			"not executable streaming",
+			"/noexec.cgi",
+			map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1},
+			http.StatusInternalServerError,
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			logged := strings.Contains(buf.String(), NotExecutableError.Error())
+			if logged != test.logged {
+				t.Fatalf("Invalid log %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestServe_ContentLengthMismatch(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "length.cgi"), `#!/bin/sh
+status=${QUERY_STRING#*&}
+printf 'Status: %s\nContent-Length: %s\n\n' "$status" "${QUERY_STRING%%&*}"
+if [ "$REQUEST_METHOD" != "HEAD" ] && [ "$status" = "200" ]; then
+  printf 'hello'
+fi
+`)
+
+	var testCases = []struct {
+		name   string
+		method string
+		query  string
+		status int
+		length string
+		body   string
+		warned bool
+	}{
+		{"under declared", "GET", "3&200", 200, "5", "hello", true},
+		{"over declared", "GET", "20&200", 200, "5", "hello", true},
+		{"correct", "GET", "5&200", 200, "5", "hello", false},
+		{"head", "HEAD", "5&200", 200, "5", "", false},
+		{"no content", "GET", "5&204", 204, "5", "", false},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			conf := map[string]any{"CGI_DIR": cgiDir}
+			r, _ := http.NewRequest(test.method, "/length.cgi?"+test.query, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Content-Length") != test.length {
+				t.Fatalf("Invalid length %s", w.Header().Get("Content-Length"))
+			}
+			if w.Body.String() != test.body {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+			warned := strings.Contains(buf.String(), "Content-Length mismatch")
+			if warned != test.warned {
+				t.Fatalf("Invalid log %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestServe_ScriptMethods(t *testing.T) {
+	var testCases = []struct {
+		name    string
+		methods map[string]any
+		method  string
+		status  int
+		allow   string
+	}{
+		{
+			"post only rejects get",
+			map[string]any{"something": []any{"POST"}},
+			"GET",
+			http.StatusMethodNotAllowed,
+			"POST",
+		},
+		{
+			"post only accepts post",
+			map[string]any{"something": []any{"POST"}},
+			"POST",
+			http.StatusOK,
+			"",
+		},
+		{
+			"glob",
+			map[string]any{"some*": []any{"POST", "PATCH"}},
+			"GET",
+			http.StatusMethodNotAllowed,
+			"POST, PATCH",
+		},
+		{
+			"case insensitive",
+			map[string]any{"something": []any{"post"}},
+			"POST",
+			http.StatusOK,
+			"",
+		},
+		{
+			"other script",
+			map[string]any{"otherthing": []any{"POST"}},
+			"GET",
+			http.StatusOK,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":        "./build",
+				"SCRIPT_METHODS": test.methods,
+			}
+			r, _ := http.NewRequest(test.method, "/something", strings.NewReader("x"))
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Allow") != test.allow {
+				t.Fatalf("Invalid Allow %s", w.Header().Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestServe_ForceClose(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		conf       map[string]any
+		connection string
+	}{
+		{
+			"streaming",
+			map[string]any{"STREAM_THRESHOLD": 1},
+			"",
+		},
+		{
+			"streaming force close",
+			map[string]any{"STREAM_THRESHOLD": 1, "FORCE_CLOSE": true},
+			"close",
+		},
+		{
+			"under threshold force close",
+			map[string]any{"STREAM_THRESHOLD": 1024, "FORCE_CLOSE": true},
+			"",
+		},
+		{
+			"buffered force close",
+			map[string]any{"FORCE_CLOSE": true},
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = "./build"
+			r, _ := http.NewRequest("GET", "/something", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Connection") != test.connection {
+				t.Fatalf("Invalid Connection %s", w.Header().Get("Connection"))
+			}
+		})
+	}
+}
+
+func TestBuildEnv(t *testing.T) {
+	conf := Config{"CGI_DIR": "./build", "CGI_PATH": "/bin"}
+	r, _ := http.NewRequest("GET", "/something?a=1", nil)
+	r.Host = "localhost:8080"
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set("Proxy", "http://evil")
+	r.Header.Set("X-Foo", "bar")
+	env, err := BuildEnv(r, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"HTTP_HOST=localhost:8080",
+		"HTTP_X_FOO=bar",
+		"PATH=/bin",
+		"PATH_INFO=",
+		"PATH_TRANSLATED=",
+		"QUERY_STRING=a=1",
+		"REMOTE_ADDR=127.0.0.1:1234",
+		"REQUEST_METHOD=GET",
+		"REQUEST_SCHEME=http",
+		"SCRIPT_FILENAME=./build/something",
+		"SCRIPT_NAME=/something",
+		"SERVER_NAME=localhost",
+		"SERVER_PORT=8080",
+		"SERVER_PROTOCOL=HTTP/1.1",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Fatalf("Invalid env %v", env)
+	}
+
+	r, _ = http.NewRequest("GET", "/something", nil)
+	r.URL.RawPath = "/some%zzthing"
+	_, err = BuildEnv(r, conf)
+	if !errors.Is(err, BadRequestPathError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+}
+
+func TestServe_ContentLengthWithoutBody(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		method string
+	}{
+		{"post", "POST"},
+		{"get", "GET"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": "./build"}
+			r, _ := http.NewRequest(test.method, "/something", nil)
+			r.ContentLength = 5
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_Trailers(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "trailer.cgi"), `#!/bin/sh
+printf 'Status: 200\nTrailer: X-Checksum\n\nthe body'
+printf 'X-Checksum: abc\nX-Other: no\n' >&3
+`)
+
+	var testCases = []struct {
+		name      string
+		threshold int
+	}{
+		{"streaming", 1},
+		{"under threshold", 1024},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":          cgiDir,
+				"STREAM_THRESHOLD": test.threshold,
+			}
+			r, _ := http.NewRequest("GET", "/trailer.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Body.String() != "the body" {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+			trailer := w.Result().Trailer
+			if trailer.Get("X-Checksum") != "abc" {
+				t.Fatalf("Invalid trailer %v", trailer)
+			}
+			if w.Header().Get("X-Other") != "" {
+				t.Fatalf("Undeclared trailer sent")
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Trailer", "X-Checksum")
+	setTrailers(w, nil)
+	if w.Header().Get("X-Checksum") != "" {
+		t.Fatalf("Invalid trailer set")
+	}
+}
+
+func TestServe_ScriptName(t *testing.T) {
+	conf := map[string]any{"CGI_DIR": "./build"}
+	r, _ := http.NewRequest("GET", "/envthing/some/thing", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	for _, v := range []string{
+		"SCRIPT_NAME=/envthing\n",
+		"SCRIPT_FILENAME=./build/envthing\n",
+		"PATH_INFO=/some/thing\n",
+	} {
+		if !strings.Contains(w.Body.String(), v) {
+			t.Fatalf("%s not in %s", v, w.Body.String())
+		}
+	}
+}
+
+func TestServe_DefaultCharset(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "type.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: $QUERY_STRING\n\nthe body"
+`)
+
+	var testCases = []struct {
+		name        string
+		conf        map[string]any
+		contentType string
+		expected    string
+	}{
+		{
+			"text without charset",
+			map[string]any{"DEFAULT_CHARSET": "utf-8"},
+			"text/html",
+			"text/html; charset=utf-8",
+		},
+		{
+			"text with charset",
+			map[string]any{"DEFAULT_CHARSET": "utf-8"},
+			"text/html;charset=latin1",
+			"text/html;charset=latin1",
+		},
+		{
+			"image",
+			map[string]any{"DEFAULT_CHARSET": "utf-8"},
+			"image/png",
+			"image/png",
+		},
+		{
+			"text without charset streaming",
+			map[string]any{"DEFAULT_CHARSET": "utf-8", "STREAM_THRESHOLD": 1},
+			"text/plain",
+			"text/plain; charset=utf-8",
+		},
+		{
+			"no default charset",
+			map[string]any{},
+			"text/html",
+			"text/html",
+		},
+		{
+			"bad content type",
+			map[string]any{"DEFAULT_CHARSET": "utf-8"},
+			"text/html;;",
+			"",
+		},
+		{
+			"bad added content type",
+			map[string]any{
+				"DEFAULT_CHARSET": "utf-8",
+				"ADD_HEADERS":     map[string]any{"Content-Type": "text/html;;"},
+			},
+			"text/html;;",
+			"text/html;;",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("GET", "/type.cgi?"+test.contentType, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Content-Type") != test.expected {
+				t.Fatalf("Invalid content type %s", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestInit_ConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	err := os.WriteFile(valid, []byte(`{
+  "CGI_DIR": "./build",
+  "STREAM_THRESHOLD": 1024,
+  "STRIP_HEADERS": ["Cookie"],
+  "INDEX_SCRIPT": "index.cgi"
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	malformed := filepath.Join(dir, "malformed.json")
+	err = os.WriteFile(malformed, []byte(`{"CGI_DIR": `), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badValue := filepath.Join(dir, "bad-value.json")
+	err = os.WriteFile(badValue, []byte(`{"CGI_DIR": "./build", "DIR_REDIRECT": "yes"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+		err  error
+	}{
+		{
+			"valid file",
+			map[string]any{"CONFIG_FILE": valid, "INDEX_SCRIPT": "main.cgi"},
+			nil,
+		},
+		{
+			"missing file",
+			map[string]any{"CONFIG_FILE": filepath.Join(dir, "missing.json")},
+			BadConfigFileError,
+		},
+		{
+			"malformed file",
+			map[string]any{"CONFIG_FILE": malformed},
+			BadConfigFileError,
+		},
+		{
+			"bad value in file",
+			map[string]any{"CONFIG_FILE": badValue},
+			BadConfigValueError,
+		},
+		{
+			"dir",
+			map[string]any{"CONFIG_FILE": dir},
+			BadConfigFileError,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := Init("some.domain", &test.conf)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Invalid error %v", err)
+			}
+		})
+	}
+
+	conf := testCases[0].conf
+	if conf["CGI_DIR"] != "./build" {
+		t.Fatalf("Invalid CGI_DIR %v", conf["CGI_DIR"])
+	}
+	threshold, _ := Config(conf).getInt("STREAM_THRESHOLD")
+	if threshold != 1024 {
+		t.Fatalf("Invalid STREAM_THRESHOLD %d", threshold)
+	}
+	if conf["INDEX_SCRIPT"] != "main.cgi" {
+		t.Fatalf("Config file replaced INDEX_SCRIPT")
+	}
+}
+
+func TestServe_SymlinkLoop(t *testing.T) {
+	cgiDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(cgiDir, "dir"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range [][2]string{
+		{"a", "b"},
+		{"b", "a"},
+		{"dir/loop", "loop"},
+	} {
+		err = os.Symlink(l[1], filepath.Join(cgiDir, l[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{"/a", "/a/some/thing", "/dir/loop", "/dir/loop/x"} {
+		t.Run(path, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": cgiDir}
+			r, _ := http.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_RedactEnv(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "dump.cgi"), `#!/bin/sh
+echo "cookie: $HTTP_COOKIE" >&2
+echo "method: $REQUEST_METHOD" >&2
+printf 'Status: 200\n\n'
+`)
+
+	var testCases = []struct {
+		name     string
+		redact   []any
+		expected string
+	}{
+		{"no redact", nil, "cookie: session=s3cr3t"},
+		{"redact", []any{"HTTP_COOKIE", "AUTH_TYPE"}, "cookie: ***"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			conf := map[string]any{"CGI_DIR": cgiDir}
+			if test.redact != nil {
+				conf["REDACT_ENV"] = test.redact
+			}
+			r, _ := http.NewRequest("GET", "/dump.cgi", nil)
+			r.Header.Set("Cookie", "session=s3cr3t")
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			out := buf.String()
+			if !strings.Contains(out, test.expected) {
+				t.Fatalf("Invalid log %s", out)
+			}
+			if !strings.Contains(out, "method: GET") {
+				t.Fatalf("Invalid log %s", out)
+			}
+		})
+	}
+}
+
+func TestServe_ClientRedirectWithDocument(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "found.cgi"), `#!/bin/sh
+printf 'Status: 302 Found\nLocation: http://example.com/new\nContent-Type: text/html\n\nmoved'
+`)
+	writeScript(t, filepath.Join(cgiDir, "nostatus.cgi"), `#!/bin/sh
+printf 'Location: http://example.com/new\nContent-Type: text/html\n\nmoved'
+`)
+
+	var testCases = []struct {
+		name string
+		path string
+		conf map[string]any
+	}{
+		{"status with reason", "/found.cgi", map[string]any{}},
+		{"default status", "/nostatus.cgi", map[string]any{}},
+		{"default status streaming", "/nostatus.cgi", map[string]any{"STREAM_THRESHOLD": 1}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusFound {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Location") != "http://example.com/new" {
+				t.Fatalf("Invalid location %s", w.Header().Get("Location"))
+			}
+			if w.Body.String() != "moved" {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestInit_Warmup(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	cgiDir := t.TempDir()
+	for _, name := range []string{"a.py", "sub/b.py", "c.cgi"} {
+		writeScript(t, filepath.Join(cgiDir, name), "")
+	}
+	warmed := filepath.Join(t.TempDir(), "warmed")
+
+	var testCases = []struct {
+		name     string
+		conf     map[string]any
+		expected []string
+		logged   bool
+	}{
+		{
+			"pattern",
+			map[string]any{
+				"WARMUP_CMD":     []any{"/bin/sh", "-c", `echo "$1" >> ` + warmed, "warmup"},
+				"WARMUP_PATTERN": "*.py",
+			},
+			[]string{
+				filepath.Join(cgiDir, "a.py"),
+				filepath.Join(cgiDir, "sub", "b.py"),
+			},
+			false,
+		},
+		{
+			"all scripts",
+			map[string]any{
+				"WARMUP_CMD": []any{"/bin/sh", "-c", `echo "$1" >> ` + warmed, "warmup"},
+			},
+			[]string{
+				filepath.Join(cgiDir, "a.py"),
+				filepath.Join(cgiDir, "c.cgi"),
+				filepath.Join(cgiDir, "sub", "b.py"),
+			},
+			false,
+		},
+		{
+			"failure",
+			map[string]any{
+				"WARMUP_CMD":     []any{"/bin/sh", "-c", "exit 1"},
+				"WARMUP_PATTERN": "*.cgi",
+			},
+			nil,
+			true,
+		},
+		{
+			"timeout",
+			map[string]any{
+				"WARMUP_CMD":     []any{"/bin/sh", "-c", "sleep 5"},
+				"WARMUP_PATTERN": "*.py",
+				"INIT_TIMEOUT":   0.2,
+			},
+			nil,
+			true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			os.Remove(warmed)
+			test.conf["CGI_DIR"] = cgiDir
+			start := time.Now()
+			err := Init("some.domain", &test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if time.Since(start) > 3*time.Second {
+				t.Fatalf("Warmup not bounded %s", time.Since(start))
+			}
+			content, _ := os.ReadFile(warmed)
+			var scripts []string
+			for _, l := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+				if l != "" {
+					scripts = append(scripts, l)
+				}
+			}
+			sort.Strings(scripts)
+			if !reflect.DeepEqual(scripts, test.expected) {
+				t.Fatalf("Invalid warmed scripts %v", scripts)
+			}
+			logged := strings.Contains(buf.String(), "warmup")
+			if logged != test.logged {
+				t.Fatalf("Invalid log %s", buf.String())
+			}
+		})
+	}
+}
+
+func TestGetIp(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		remoteAddr string
+		conf       Config
+		expected   string
+	}{
+		{"tcp", "127.0.0.1:1234", Config{}, "127.0.0.1:1234"},
+		{"unix empty", "", Config{}, "unix"},
+		{"unix at", "@", Config{}, "unix"},
+		{
+			"unix configured",
+			"@",
+			Config{"UNIX_REMOTE_ADDR": "127.0.0.1"},
+			"127.0.0.1",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.RemoteAddr = test.remoteAddr
+			ip := getIp(r, test.conf)
+			if ip != test.expected {
+				t.Fatalf("Invalid ip %s", ip)
+			}
+		})
+	}
+}
+
+func TestServe_ChunkedRequest(t *testing.T) {
+	conf := map[string]any{"CGI_DIR": "./build"}
+	r, _ := http.NewRequest("POST", "/envthing", strings.NewReader("the body"))
+	r.ContentLength = -1
+	r.TransferEncoding = []string{"chunked"}
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "CONTENT_LENGTH") {
+		t.Fatalf("CONTENT_LENGTH for chunked request %s", w.Body.String())
+	}
+}
+
+func TestServe_ForceDownloadExtensions(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "report"), `#!/bin/sh
+if [ "$QUERY_STRING" = "inline" ]; then
+    printf 'Content-Disposition: inline\n'
+fi
+printf 'Status: 200\nContent-Type: text/csv\n\na,b\n1,2\n'
+`)
+
+	var testCases = []struct {
+		name        string
+		conf        map[string]any
+		path        string
+		disposition string
+	}{
+		{
+			"csv",
+			map[string]any{"FORCE_DOWNLOAD_EXTENSIONS": []any{".csv"}},
+			"/report/data.CSV",
+			"attachment",
+		},
+		{
+			"csv streaming",
+			map[string]any{
+				"FORCE_DOWNLOAD_EXTENSIONS": []any{".csv"},
+				"STREAM_THRESHOLD":          1,
+			},
+			"/report/data.csv",
+			"attachment",
+		},
+		{
+			"set by the cgi",
+			map[string]any{"FORCE_DOWNLOAD_EXTENSIONS": []any{".csv"}},
+			"/report/data.csv?inline",
+			"inline",
+		},
+		{
+			"other extension",
+			map[string]any{"FORCE_DOWNLOAD_EXTENSIONS": []any{".csv"}},
+			"/report/data.html",
+			"",
+		},
+		{
+			"not configured",
+			map[string]any{},
+			"/report/data.csv",
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			disposition := w.Header().Get("Content-Disposition")
+			if disposition != test.disposition {
+				t.Fatalf("Invalid Content-Disposition %s", disposition)
+			}
+		})
+	}
+}
+
+func TestWriteCgiError(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(io.Discard)
+	pagesDir := t.TempDir()
+	notFound := filepath.Join(pagesDir, "404.html")
+	serverError := filepath.Join(pagesDir, "500.html")
+	os.WriteFile(notFound, []byte("<h1>not here</h1>"), 0644)
+	os.WriteFile(serverError, []byte("<h1>broken</h1>"), 0644)
+	pages := map[string]any{
+		"404": notFound,
+		"500": serverError,
+		"400": filepath.Join(pagesDir, "missing.html"),
+	}
+
+	var testCases = []struct {
+		name    string
+		path    string
+		rawPath string
+		conf    map[string]any
+		status  int
+		body    string
+	}{
+		{"not found", "/missing", "", map[string]any{}, 404, "NOT FOUND\n"},
+		{
+			"not found page",
+			"/missing",
+			"",
+			map[string]any{"ERROR_PAGES": pages},
+			404,
+			"<h1>not here</h1>",
+		},
+		{
+			"script error",
+			"/otherthing?error=1",
+			"",
+			map[string]any{},
+			500,
+			INTERNAL_SERVER_ERROR_MSG + "\n",
+		},
+		{
+			"script error page",
+			"/otherthing?error=1",
+			"",
+			map[string]any{"ERROR_PAGES": pages},
+			500,
+			"<h1>broken</h1>",
+		},
+		{
+			"script error page streaming",
+			"/otherthing?error=1",
+			"",
+			map[string]any{"ERROR_PAGES": pages, "STREAM_THRESHOLD": 1},
+			500,
+			"<h1>broken</h1>",
+		},
+		{
+			"bad request missing page",
+			"/something",
+			"/some%zzthing",
+			map[string]any{"ERROR_PAGES": pages},
+			400,
+			"Bad request\n",
+		},
+		{
+			"unauthorized",
+			"/something",
+			"",
+			map[string]any{"REQUIRE_AUTH": true},
+			401,
+			"Unauthorized\n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = "./build"
+			r, _ := http.NewRequest("GET", test.path, nil)
+			r.URL.RawPath = test.rawPath
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Body.String() != test.body {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	WriteCgiError(w, http.StatusTeapot, Config{})
+	if w.Code != http.StatusTeapot || w.Body.String() != "I'm a teapot\n" {
+		t.Fatalf("Invalid response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestServe_RequireContentType(t *testing.T) {
+	required := map[string]any{"some*": []any{"application/json"}}
+
+	var testCases = []struct {
+		name        string
+		path        string
+		contentType string
+		status      int
+	}{
+		{"mismatched", "/something", "text/plain", http.StatusUnsupportedMediaType},
+		{"missing", "/something", "", http.StatusUnsupportedMediaType},
+		{"matched", "/something", "application/json", http.StatusOK},
+		{"matched with params", "/something", "Application/JSON; charset=utf-8", http.StatusOK},
+		{"other script", "/otherthing?status=200", "text/plain", http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":              "./build",
+				"REQUIRE_CONTENT_TYPE": required,
+			}
+			r, _ := http.NewRequest("POST", test.path, strings.NewReader("{}"))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_WebDAVMethods(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "dav.cgi"), `#!/bin/sh
+printf 'Status: 207\nContent-Type: text/plain\n\n'
+printf 'method: %s\n' "$REQUEST_METHOD"
+cat
+`)
+
+	var testCases = []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"propfind with body", "PROPFIND", `<?xml version="1.0"?><propfind xmlns="DAV:"><allprop/></propfind>`},
+		{"mkcol without body", "MKCOL", ""},
+		{"move", "MOVE", ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": cgiDir}
+			var body io.Reader
+			if test.body != "" {
+				body = strings.NewReader(test.body)
+			}
+			r, _ := http.NewRequest(test.method, "/dav.cgi/some/dir", body)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusMultiStatus {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			expected := "method: " + test.method + "\n" + test.body
+			if w.Body.String() != expected {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_AutoETag(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "page.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\nsome page"
+`)
+	writeScript(t, filepath.Join(cgiDir, "tagged.cgi"), `#!/bin/sh
+printf "Status: 200\nETag: \"v1\"\n\nsome page"
+`)
+	conf := map[string]any{"CGI_DIR": cgiDir, "AUTO_ETAG": true}
+	r, _ := http.NewRequest("GET", "/page.cgi", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Body.String() != "some page" {
+		t.Fatalf("Invalid response %d %s %s", w.Code, etag, w.Body.String())
+	}
+
+	var testCases = []struct {
+		name        string
+		conf        map[string]any
+		method      string
+		path        string
+		ifNoneMatch string
+		status      int
+		etag        string
+	}{
+		{"hit", conf, "GET", "/page.cgi", etag, http.StatusNotModified, etag},
+		{"weak hit", conf, "GET", "/page.cgi", `"x", W/` + etag, http.StatusNotModified, etag},
+		{"miss", conf, "GET", "/page.cgi", `"other"`, http.StatusOK, etag},
+		{"post", conf, "POST", "/page.cgi", etag, http.StatusOK, etag},
+		{"head", conf, "HEAD", "/page.cgi", etag, http.StatusOK, ""},
+		{"script etag", conf, "GET", "/tagged.cgi", etag, http.StatusOK, `"v1"`},
+		{
+			"disabled",
+			map[string]any{"CGI_DIR": cgiDir},
+			"GET",
+			"/page.cgi",
+			etag,
+			http.StatusOK,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest(test.method, test.path, nil)
+			r.Header.Set("If-None-Match", test.ifNoneMatch)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("ETag") != test.etag {
+				t.Fatalf("Invalid etag %s", w.Header().Get("ETag"))
+			}
+			if test.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_StatusOnly(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "nocontent.cgi"), `#!/bin/sh
+printf "Status: 204\n\n"
+`)
+	output := []byte("Status: 204\n\n")
+	headers, body, err := parseCgiResponse(&output)
+	if err != nil || headers.Get("Status") != "204" || len(*body) != 0 {
+		t.Fatalf("Invalid response %v %q %v", headers, *body, err)
+	}
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{"CGI_DIR": cgiDir}},
+		{"stream", map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1024}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					Serve(w, r, &test.conf)
+				}))
+			defer server.Close()
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte("GET /nocontent.cgi HTTP/1.1\r\nHost: localhost\r\n" +
+				"Connection: close\r\n\r\n"))
+			raw, _ := io.ReadAll(conn)
+			head, body, _ := strings.Cut(string(raw), "\r\n\r\n")
+			if !strings.HasPrefix(head, "HTTP/1.1 204 ") {
+				t.Fatalf("Invalid status %s", head)
+			}
+			if strings.Contains(strings.ToLower(head), "content-length") {
+				t.Fatalf("Invalid headers %s", head)
+			}
+			if body != "" {
+				t.Fatalf("Invalid body %q", body)
+			}
+		})
+	}
+}
+
+func TestServe_NoStatusHeader(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "created.cgi"), `#!/bin/sh
+printf "Status: 201 Created\nContent-Type: text/plain\n\ncreated"
+`)
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{"CGI_DIR": cgiDir}},
+		{"stream", map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/created.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if _, exists := w.Header()["Status"]; exists {
+				t.Fatalf("Status header sent %v", w.Header())
+			}
+		})
+	}
+}
+
+func TestServe_HeaderTimeout(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "slow.cgi"), `#!/bin/sh
+exec sleep 5
+`)
+	writeScript(t, filepath.Join(cgiDir, "stream.cgi"), `#!/bin/sh
+printf "Status: 200\nContent-Type: text/plain\n\n"
+sleep 0.3
+printf "done"
+`)
+
+	var testCases = []struct {
+		name      string
+		path      string
+		threshold int
+		status    int
+		body      string
+	}{
+		{"delayed headers", "/slow.cgi", 1024, http.StatusGatewayTimeout, ""},
+		{"slow body", "/stream.cgi", 1024, http.StatusOK, "done"},
+		{"buffered delayed headers", "/slow.cgi", 0, http.StatusGatewayTimeout, ""},
+		{"buffered slow body", "/stream.cgi", 0, http.StatusOK, "done"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": cgiDir, "HEADER_TIMEOUT": 0.1}
+			if test.threshold > 0 {
+				conf["STREAM_THRESHOLD"] = test.threshold
+			}
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			start := time.Now()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), test.body) {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+			if time.Since(start) > time.Second {
+				t.Fatalf("Header timeout not used")
+			}
+		})
+	}
+}
+
+func TestServe_FallbackScript(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		conf   map[string]any
+		path   string
+		status int
+		body   string
+	}{
+		{
+			"fallback",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": "envthing"},
+			"/any/route",
+			http.StatusOK,
+			"\nPATH_INFO=/any/route\n",
+		},
+		{
+			"fallback script name",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": "envthing"},
+			"/any/route",
+			http.StatusOK,
+			"\nSCRIPT_NAME=/envthing\n",
+		},
+		{
+			"script found",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": "envthing"},
+			"/something",
+			http.StatusOK,
+			"",
+		},
+		{
+			"missing fallback",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": "index.php"},
+			"/any/route",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"fallback outside cgi dir",
+			map[string]any{"CGI_DIR": "./build", "FALLBACK_SCRIPT": "../build/envthing"},
+			"/any/route",
+			http.StatusNotFound,
+			"",
+		},
+		{
+			"no fallback",
+			map[string]any{"CGI_DIR": "./build"},
+			"/any/route",
+			http.StatusNotFound,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if !strings.Contains(w.Body.String(), test.body) {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_DebugRouting(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		path     string
+		debug    bool
+		status   int
+		script   string
+		pathInfo string
+	}{
+		{"with path info", "/something/extra", true, http.StatusOK, "./build/something", "/extra"},
+		{"not found", "/missing/extra", true, http.StatusNotFound, "", "/missing/extra"},
+		{"off", "/something/extra", false, http.StatusOK, "", ""},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": "./build", "DEBUG_ROUTING": test.debug}
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("X-CGI-Script") != test.script {
+				t.Fatalf("Invalid X-CGI-Script %s", w.Header().Get("X-CGI-Script"))
+			}
+			if w.Header().Get("X-CGI-Path-Info") != test.pathInfo {
+				t.Fatalf("Invalid X-CGI-Path-Info %s", w.Header().Get("X-CGI-Path-Info"))
+			}
+		})
+	}
+}
+
+func TestServe_ReadTimeout(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		timeout  any
+		complete bool
+		status   string
+	}{
+		{"slow body", 0.2, false, "HTTP/1.1 408 "},
+		{"in time", 5, true, "HTTP/1.1 200 "},
+		{"no timeout", nil, true, "HTTP/1.1 200 "},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": "./build"}
+			if test.timeout != nil {
+				conf["READ_TIMEOUT"] = test.timeout
+			}
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					Serve(w, r, &conf)
+				}))
+			defer server.Close()
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			// the client sends part of the body and stalls
+			conn.Write([]byte("POST /something HTTP/1.1\r\nHost: localhost\r\n" +
+				"Connection: close\r\nContent-Length: 8\r\n\r\nthe "))
+			if test.complete {
+				time.Sleep(300 * time.Millisecond)
+				conn.Write([]byte("body"))
+			}
+			status, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(status, test.status) {
+				t.Fatalf("Invalid status %s", status)
+			}
+		})
+	}
+}
+
+func TestServe_BOM(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "bom.cgi"), `#!/bin/sh
+printf '\357\273\277Status: 200\nContent-Type: text/plain\n\nthe body'
+`)
+
+	var testCases = []struct {
+		name string
+		conf map[string]any
+	}{
+		{"buffered", map[string]any{"CGI_DIR": cgiDir}},
+		{"streaming", map[string]any{"CGI_DIR": cgiDir, "STREAM_THRESHOLD": 1}},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/bom.cgi", nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Content-Type") != "text/plain" {
+				t.Fatalf("Invalid content type %s", w.Header().Get("Content-Type"))
+			}
+			if w.Body.String() != "the body" {
+				t.Fatalf("Invalid body %s", w.Body.String())
+			}
+		})
+	}
+
+	response := []byte("\xEF\xBB\xBFStatus: 200\n\nthe body")
+	headers, body, err := parseCgiResponse(&response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if headers.Get("Status") != "200" || string(*body) != "the body" {
+		t.Fatalf("Invalid response %v %s", headers, *body)
+	}
+}
+
+func TestServe_CollapseSlashes(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		path     string
+		collapse bool
+		pathInfo string
+	}{
+		{"double slashes", "/something//extra//path", true, "/extra/path"},
+		{"leading slashes", "//something/extra", true, "/extra"},
+		{"trailing slashes", "/something/extra//", true, "/extra/"},
+		{"not collapsed", "/something/extra//path", false, "/extra//path"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{
+				"CGI_DIR":          "./build",
+				"COLLAPSE_SLASHES": test.collapse,
+				"DEBUG_ROUTING":    true,
+			}
+			r, _ := http.NewRequest("GET", "/", nil)
+			r.URL.Path = test.path
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			pathInfo := w.Header().Get("X-CGI-Path-Info")
+			if pathInfo != test.pathInfo {
+				t.Fatalf("Invalid path info %s", pathInfo)
+			}
+		})
+	}
+}
+
+func TestExportedTypes(t *testing.T) {
+	// the plugin users can only name builtin types in the type
+	// assertions of the symbols they look up.
+	var symbols = []any{
+		NewHandler,
+		ParseResponse,
+		BuildEnv,
+		WriteCgiError,
+		Reload,
+		Domains,
+	}
+	for _, sym := range symbols {
+		switch sym.(type) {
+		case func(string, map[string]any) (http.Handler, error),
+			func(io.Reader) (http.Header, io.Reader, int, error),
+			func(*http.Request, map[string]any) ([]string, error),
+			func(http.ResponseWriter, int, map[string]any),
+			func(string, map[string]any) error,
+			func() map[string]string:
+		default:
+			t.Fatalf("Symbol not usable through plugin.Lookup %T", sym)
+		}
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	_, err := NewHandler("some.domain", map[string]any{})
+	if !errors.Is(err, NoCgiDirError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+
+	handler, err := NewHandler("some.domain", map[string]any{"CGI_DIR": "./build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/something", "text/plain", strings.NewReader("the body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Invalid status code %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "the body" {
+		t.Fatalf("Invalid body %s", body)
+	}
+}
+
+func TestServe_TrustEnvHeaders(t *testing.T) {
+	headers := map[string]string{
+		"X-CGI-Env-FOO":                "bar",
+		"X-Cgi-Env-Other-Var":          "other",
+		"X-CGI-Env-Path":               "/tmp",
+		"X-CGI-Env-Script-Filename":    "/bin/sh",
+		"X-CGI-Env-1bad":               "bad",
+		"X-CGI-Env-Http-Proxy":         "http://evil.proxy",
+		"X-CGI-Env-Http-Authorization": "Bearer evil",
+		"X-CGI-Env-LD-PRELOAD":         "/tmp/evil.so",
+		"X-CGI-Env-Bash-Env":           "/tmp/evil.sh",
+		"X-CGI-Env-Env":                "/tmp/evil.sh",
+		"X-CGI-Env-Content-Length":     "999",
+		"X-CGI-Env-Remote-Host":        "evil",
+		"X-Other":                      "other",
+	}
+	reserved := []string{
+		"PATH=/tmp", "1BAD", "HTTP_PROXY", "HTTP_AUTHORIZATION", "LD_PRELOAD",
+		"BASH_ENV", "\nENV=", "CONTENT_LENGTH", "REMOTE_HOST",
+	}
+
+	var testCases = []struct {
+		name     string
+		prefix   string
+		names    []any
+		expected []string
+		absent   []string
+	}{
+		{
+			"enabled",
+			"X-CGI-Env-",
+			nil,
+			[]string{
+				"FOO=bar\n",
+				"OTHER_VAR=other\n",
+				"SCRIPT_FILENAME=./build/envthing\n",
+				"HTTP_X_OTHER=other\n",
+			},
+			append([]string{"HTTP_X_CGI_ENV_FOO"}, reserved...),
+		},
+		{
+			"allowed names",
+			"X-CGI-Env-",
+			[]any{"FOO", "HTTP_PROXY"},
+			[]string{"FOO=bar\n"},
+			append([]string{"OTHER_VAR"}, reserved...),
+		},
+		{
+			"disabled",
+			"",
+			nil,
+			[]string{"HTTP_X_CGI_ENV_FOO=bar\n"},
+			[]string{"\nFOO=bar", "\nOTHER_VAR"},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": "./build"}
+			if test.prefix != "" {
+				conf["TRUST_ENV_HEADERS"] = test.prefix
+			}
+			if test.names != nil {
+				conf["TRUST_ENV_NAMES"] = test.names
+			}
+			r, _ := http.NewRequest("GET", "/envthing", nil)
+			for k, v := range headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			body := w.Body.String()
+			for _, e := range test.expected {
+				if !strings.Contains(body, e) {
+					t.Fatalf("%s not in %s", e, body)
+				}
+			}
+			for _, a := range test.absent {
+				if strings.Contains(body, a) {
+					t.Fatalf("%s in %s", a, body)
+				}
+			}
+		})
+	}
+}
+
+func TestServe_DirectoryWithoutIndex(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "app", "other.cgi"), `#!/bin/sh
+printf 'Status: 200\n\n'
+`)
+	writeScript(t, filepath.Join(cgiDir, "withindex", "index.cgi"), `#!/bin/sh
+printf 'Status: 200\n\nindex'
+`)
+
+	var testCases = []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"directory", "/app", http.StatusNotFound},
+		{"directory with path info", "/app/missing", http.StatusNotFound},
+		{"script in directory", "/app/other.cgi", http.StatusOK},
+		{"directory with index", "/withindex", http.StatusOK},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conf := map[string]any{"CGI_DIR": cgiDir, "INDEX_SCRIPT": "index.cgi"}
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestServe_AccessLog(t *testing.T) {
+	defer func() { now = time.Now }()
+	defer log.SetOutput(os.Stderr)
+	log.SetOutput(io.Discard)
+	now = func() time.Time {
+		return time.Date(2024, 3, 5, 10, 20, 30, 0, time.FixedZone("", -3*3600))
+	}
+	logDir := t.TempDir()
+	clf := regexp.MustCompile(
+		`^(\S+) - (\S+) \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-)$`)
+
+	var testCases = []struct {
+		name     string
+		path     string
+		user     string
+		conf     map[string]any
+		expected []string
+	}{
+		{
+			"ok",
+			"/something?a=1",
+			"",
+			map[string]any{},
+			[]string{"127.0.0.1", "-", "05/Mar/2024:10:20:30 -0300", "GET",
+				"/something", "HTTP/1.1", "200", "33"},
+		},
+		{
+			"query string",
+			"/something?a=1",
+			"",
+			map[string]any{"LOG_QUERY_STRING": true},
+			[]string{"127.0.0.1", "-", "05/Mar/2024:10:20:30 -0300", "GET",
+				"/something?a=1", "HTTP/1.1", "200", "33"},
+		},
+		{
+			"not found with user",
+			"/missing",
+			"juca",
+			map[string]any{},
+			[]string{"127.0.0.1", "juca", "05/Mar/2024:10:20:30 -0300", "GET",
+				"/missing", "HTTP/1.1", "404", "10"},
+		},
+		{
+			"streaming",
+			"/something",
+			"",
+			map[string]any{"STREAM_THRESHOLD": 1},
+			[]string{"127.0.0.1", "-", "05/Mar/2024:10:20:30 -0300", "GET",
+				"/something", "HTTP/1.1", "200", "15"},
+		},
+		{
+			"no body",
+			"/otherthing?status=204",
+			"",
+			map[string]any{},
+			[]string{"127.0.0.1", "-", "05/Mar/2024:10:20:30 -0300", "GET",
+				"/otherthing", "HTTP/1.1", "204", "-"},
+		},
+	}
+
+	for i, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			logFile := filepath.Join(logDir, strconv.Itoa(i)+".log")
+			test.conf["CGI_DIR"] = "./build"
+			test.conf["ACCESS_LOG"] = logFile
+			r, _ := http.NewRequest("GET", test.path, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			if test.user != "" {
+				r.SetBasicAuth(test.user, "pwd")
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			content, err := os.ReadFile(logFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			match := clf.FindStringSubmatch(strings.TrimSuffix(string(content), "\n"))
+			if match == nil {
+				t.Fatalf("Invalid log line %s", content)
+			}
+			if !reflect.DeepEqual(match[1:], test.expected) {
+				t.Fatalf("Invalid log line %s", content)
+			}
+		})
+	}
+
+	// a log that can not be opened is only reported
+	conf := map[string]any{
+		"CGI_DIR":    "./build",
+		"ACCESS_LOG": filepath.Join(logDir, "missing", "access.log"),
+	}
+	r, _ := http.NewRequest("GET", "/something", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+}
+
+func TestWriteAccessLog_Stdout(t *testing.T) {
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = out
+
+	r, _ := http.NewRequest("GET", "/something", nil)
+	aw := &accessLogWriter{ResponseWriter: httptest.NewRecorder()}
+	aw.Write([]byte("body"))
+	writeAccessLog("stdout", r, aw, Config{})
+	content, _ := os.ReadFile(out.Name())
+	if !strings.Contains(string(content), `"GET /something HTTP/1.1" 200 4`) {
+		t.Fatalf("Invalid log line %s", content)
+	}
+}
+
+func TestServe_QueryAsArg(t *testing.T) {
+	var testCases = []struct {
+		name string
+		conf map[string]any
+		path string
+		args string
+	}{
+		{
+			"single arg",
+			map[string]any{"QUERY_AS_ARG": true},
+			"/envthing?foo+bar%20baz",
+			"args: foo+bar%20baz\n",
+		},
+		{
+			"with equal sign",
+			map[string]any{"QUERY_AS_ARG": true},
+			"/envthing?foo=bar",
+			"args: \n",
+		},
+		{
+			"isindex precedence",
+			map[string]any{"QUERY_AS_ARG": true, "ISINDEX_ARGS": true},
+			"/envthing?foo+bar",
+			"args: foo bar\n",
+		},
+		{
+			"disabled",
+			map[string]any{},
+			"/envthing?foo+bar",
+			"args: \n",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = "./build"
+			r, _ := http.NewRequest("GET", test.path, nil)
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if !strings.HasPrefix(w.Body.String(), test.args) {
+				t.Fatalf("Invalid args %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestServe_Interpreters(t *testing.T) {
+	cgiDir := t.TempDir()
+	script := filepath.Join(cgiDir, "app.sh")
+	// not executable, it is run by the interpreter
+	err := os.WriteFile(script, []byte(`printf 'Status: 200\n\nargs: %s' "$*"`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := map[string]any{
+		"CGI_DIR":      cgiDir,
+		"INTERPRETERS": map[string]any{".sh": "/bin/sh"},
+		"ISINDEX_ARGS": true,
+	}
+	err = Init("some.domain", &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("GET", "/app.sh?a+b", nil)
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if w.Body.String() != "args: a b" {
+		t.Fatalf("Invalid body %s", w.Body.String())
+	}
+
+	conf["INTERPRETERS"] = map[string]any{".sh": "/no/such/sh", ".py": "/no/such/py"}
+	err = Init("some.domain", &conf)
+	if !errors.Is(err, MissingInterpreterError) {
+		t.Fatalf("Invalid error %v", err)
+	}
+	if !strings.Contains(err.Error(), "/no/such/py, /no/such/sh") {
+		t.Fatalf("Missing interpreters not listed %s", err.Error())
+	}
+}
+
+func TestServe_MaxConcurrent(t *testing.T) {
+	cgiDir := t.TempDir()
+	writeScript(t, filepath.Join(cgiDir, "app.cgi"), `#!/bin/sh
+printf 'Status: 200\n\n'
+`)
+
+	var testCases = []struct {
+		name       string
+		conf       map[string]any
+		host       string
+		busy       int
+		status     int
+		retryAfter string
+	}{
+		{
+			"free slot",
+			map[string]any{"MAX_CONCURRENT": 2},
+			"",
+			1,
+			http.StatusOK,
+			"",
+		},
+		{
+			"limit hit",
+			map[string]any{"MAX_CONCURRENT": 2, "RETRY_AFTER": 5},
+			"",
+			2,
+			http.StatusServiceUnavailable,
+			"5",
+		},
+		{
+			"limit hit default retry after",
+			map[string]any{"MAX_CONCURRENT": 2},
+			"",
+			2,
+			http.StatusServiceUnavailable,
+			"1",
+		},
+		{
+			"no limit",
+			map[string]any{},
+			"",
+			0,
+			http.StatusOK,
+			"",
+		},
+		{
+			"limit changed by reload",
+			map[string]any{"MAX_CONCURRENT": 3},
+			"",
+			2,
+			http.StatusOK,
+			"",
+		},
+		{
+			"other domain",
+			map[string]any{"MAX_CONCURRENT": 2},
+			"other.net",
+			2,
+			http.StatusOK,
+			"",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			test.conf["CGI_DIR"] = cgiDir
+			s := getSlots("", cgiDir, 2)
+			for i := 0; i < test.busy; i++ {
+				s <- struct{}{}
+			}
+			defer func() {
+				for i := 0; i < test.busy; i++ {
+					<-s
+				}
+			}()
+			r, _ := http.NewRequest("GET", "/app.cgi", nil)
+			r.Host = test.host
+			w := httptest.NewRecorder()
+			Serve(w, r, &test.conf)
+			if w.Code != test.status {
+				t.Fatalf("Invalid status code %d", w.Code)
+			}
+			if w.Header().Get("Retry-After") != test.retryAfter {
+				t.Fatalf("Invalid Retry-After %s", w.Header().Get("Retry-After"))
+			}
+			if len(s) != test.busy {
+				t.Fatalf("Slot not released")
+			}
+		})
+	}
+}
+
+func TestGetMetaVars_OmitEmptyPathInfo(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		path     string
+		conf     Config
+		expected map[string]string
+		missing  []string
+	}{
+		{
+			"empty path info",
+			"/something",
+			Config{"CGI_DIR": "./build"},
+			map[string]string{"PATH_INFO": "", "PATH_TRANSLATED": ""},
+			nil,
+		},
+		{
+			"omit empty path info",
+			"/something",
+			Config{"CGI_DIR": "./build", "OMIT_EMPTY_PATH_INFO": true},
+			map[string]string{},
+			[]string{"PATH_INFO", "PATH_TRANSLATED"},
+		},
+		{
+			"omit with path info",
+			"/something/the/path",
+			Config{"CGI_DIR": "./build", "OMIT_EMPTY_PATH_INFO": true},
+			map[string]string{
+				"PATH_INFO":       "/the/path",
+				"PATH_TRANSLATED": "./build/the/path",
+			},
+			nil,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.path, nil)
+			meta, err := getMetaVars(r, test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range test.expected {
+				if value, exists := meta[k]; !exists || value != v {
+					t.Fatalf("Bad %s: %s", k, value)
+				}
+			}
+			for _, k := range test.missing {
+				if _, exists := meta[k]; exists {
+					t.Fatalf("%s should not be present", k)
+				}
+			}
+		})
+	}
+}
+
+func TestGetMetaVars_DowngradeProtocol(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		proto    string
+		major    int
+		conf     Config
+		expected string
+	}{
+		{"http2", "HTTP/2.0", 2, Config{"CGI_DIR": "./build"}, "HTTP/2.0"},
+		{
+			"http2 downgraded",
+			"HTTP/2.0",
+			2,
+			Config{"CGI_DIR": "./build", "DOWNGRADE_PROTOCOL": true},
+			"HTTP/1.1",
+		},
+		{
+			"http1.0 not downgraded",
+			"HTTP/1.0",
+			1,
+			Config{"CGI_DIR": "./build", "DOWNGRADE_PROTOCOL": true},
+			"HTTP/1.0",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.Proto = test.proto
+			r.ProtoMajor = test.major
+			meta, err := getMetaVars(r, test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta["SERVER_PROTOCOL"] != test.expected {
+				t.Fatalf("Invalid protocol %s", meta["SERVER_PROTOCOL"])
+			}
+		})
+	}
+}
+
+func TestGetSchemeForRequest(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		url       string
+		tls       bool
+		forwarded string
+		conf      Config
+		scheme    string
+	}{
+		{"http", "/something", false, "", Config{}, "http"},
+		{"https", "/something", true, "", Config{}, "https"},
+		{"url scheme", "https://localhost/something", false, "", Config{}, "https"},
+		{
+			"forwarded trusted",
+			"/something",
+			false,
+			"HTTPS, http",
+			Config{"TRUST_FORWARDED_HEADERS": true},
+			"https",
+		},
+		{"forwarded not trusted", "/something", false, "https", Config{}, "http"},
+		{
+			"bad forwarded",
+			"/something",
+			true,
+			"gopher",
+			Config{"TRUST_FORWARDED_HEADERS": true},
+			"https",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", test.url, nil)
+			if test.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-Proto", test.forwarded)
+			}
+			scheme := getSchemeForRequest(r, test.conf)
+			if scheme != test.scheme {
+				t.Fatalf("Invalid scheme %s", scheme)
+			}
+		})
+	}
+}
+
+func TestGetDomainForRequest(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		host   string
+		domain string
+	}{
+		{"domain", "example.com", "example.com"},
+		{"port", "example.com:8080", "example.com"},
+		{"fqdn", "Example.COM.", "example.com"},
+		{"fqdn with port", "Example.COM.:8080", "example.com"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.Host = test.host
+			domain := getDomainForRequest(r)
+			if domain != test.domain {
+				t.Fatalf("Invalid domain %s", domain)
+			}
+		})
+	}
+}
+
+func TestGetRequestMethod(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		method   string
+		override string
+		conf     Config
+		expected string
+	}{
+		{"post", "POST", "put", Config{"METHOD_OVERRIDE": true}, "PUT"},
+		{"disabled", "POST", "PUT", Config{}, "POST"},
+		{"not post", "GET", "DELETE", Config{"METHOD_OVERRIDE": true}, "GET"},
+		{"no header", "POST", "", Config{"METHOD_OVERRIDE": true}, "POST"},
+		{"bad method", "POST", "PU T", Config{"METHOD_OVERRIDE": true}, "POST"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest(test.method, "/something", nil)
+			if test.override != "" {
+				r.Header.Set("X-HTTP-Method-Override", test.override)
+			}
+			method := getRequestMethod(r, test.conf)
+			if method != test.expected {
+				t.Fatalf("Invalid method %s", method)
+			}
+		})
+	}
+}
+
+func TestServe_MethodOverride(t *testing.T) {
+	conf := map[string]any{
+		"CGI_DIR":         "./build",
+		"METHOD_OVERRIDE": true,
+		"SCRIPT_METHODS":  map[string]any{"envthing": []any{"PUT"}},
+	}
+	r, _ := http.NewRequest("POST", "/envthing", strings.NewReader("a=b"))
+	r.Header.Set("X-HTTP-Method-Override", "PUT")
+	w := httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "\nREQUEST_METHOD=PUT\n") {
+		t.Fatalf("Invalid body %s", w.Body.String())
+	}
+
+	r, _ = http.NewRequest("POST", "/envthing", strings.NewReader("a=b"))
+	w = httptest.NewRecorder()
+	Serve(w, r, &conf)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Invalid status code %d", w.Code)
+	}
+}
+
+func TestGetPortForRequest(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		host      string
+		forwarded string
+		conf      Config
+		port      int
+	}{
+		{"host port", "localhost:8080", "", Config{}, 8080},
+		{"public port", "localhost:8080", "", Config{"PUBLIC_PORT": 443}, 443},
+		{
+			"public port over forwarded",
+			"localhost:8080",
+			"8443",
+			Config{"PUBLIC_PORT": 443, "TRUST_FORWARDED_HEADERS": true},
+			443,
+		},
+		{
+			"forwarded trusted",
+			"localhost:8080",
+			"443",
+			Config{"TRUST_FORWARDED_HEADERS": true},
+			443,
+		},
+		{"forwarded not trusted", "localhost:8080", "443", Config{}, 8080},
+		{
+			"bad forwarded",
+			"localhost:8080",
+			"99999",
+			Config{"TRUST_FORWARDED_HEADERS": true},
+			8080,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/something", nil)
+			r.Host = test.host
+			if test.forwarded != "" {
+				r.Header.Set("X-Forwarded-Port", test.forwarded)
+			}
+			port, err := getPortForRequest(r, test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if port != test.port {
+				t.Fatalf("Invalid port %d", port)
+			}
+		})
+	}
+}
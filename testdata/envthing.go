@@ -0,0 +1,18 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	env := os.Environ()
+	sort.Strings(env)
+	fmt.Fprintf(os.Stdout, "Status: 200\nContent-Type: text/plain\n\n")
+	fmt.Fprintf(os.Stdout, "args: %s\n", strings.Join(os.Args[1:], " "))
+	for _, e := range env {
+		fmt.Fprintln(os.Stdout, e)
+	}
+}
@@ -10,7 +10,7 @@ import (
 func main() {
 	method, _ := os.LookupEnv("REQUEST_METHOD")
 	me := strings.ToLower(method)
-	if me != "get" && me != "post" {
+	if me != "get" && me != "post" && me != "patch" && me != "delete" {
 		fmt.Printf("Status: 405\n\n")
 		os.Exit(0)
 	}
@@ -26,6 +26,11 @@ func main() {
 
 	}
 
+	if me == "patch" || me == "delete" {
+		body, _ := io.ReadAll(os.Stdin)
+		b += "\n" + string(body)
+	}
+
 	fmt.Fprintf(os.Stdout, "Status: 200\nContent-Type: text/plain\n\n"+b)
 	os.Exit(0)
 }